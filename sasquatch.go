@@ -1,442 +1,7535 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/net/netutil"
 )
 
 const version = "2"
-const defaultVisibilityTimeout = 30
-const maxVisibilityTimeout = 43200
-const maxReceives = 4                  // Define maximum receive count
-const cleanupInterval = 1 * time.Minute // Interval for running the cleanup task
-const defaultMaxMessageSize = 256 * 1024 // Default maximum message size in bytes
-const maxAllowedMessageSize = 10 * 1024 * 1024 // Maximum allowed message size in bytes (10MB)
+const defaultVisibilityTimeout = 30                 // Default of --default-visibility-timeout
+const maxVisibilityTimeout = 43200                  // Longest visibility timeout in seconds a dequeue may ask for
+const defaultMaxReceives = 4                        // Default of --max-receives
+const defaultCleanupInterval = 1 * time.Minute      // Default of --cleanup-interval
+const cleanupWarnThreshold = 5 * time.Second        // Cleanup runs slower than this are logged, since they hold the lock
+const cleanupRetryInterval = 10 * time.Second       // How soon a cleanup run skipped because of lock contention is retried
+const cleanupLockRetryDelay = 10 * time.Millisecond // Pause between cleanup's attempts to take a busy lock
+const defaultMaxMessageSize = 256 * 1024            // Default maximum message size in bytes
+const maxAllowedMessageSize = 10 * 1024 * 1024      // Maximum allowed message size in bytes (10MB)
+const longPollTimeout = 30 * time.Second            // How long a dequeue waits for a message before returning 204
+const longPollRetryAfter = 5                        // Seconds a consumer is told to back off when a queue has too many long polls
+const inFlightRetryAfter = 1                        // Seconds a consumer is told to back off when the server has too many messages in flight
+const defaultRetentionSeconds = 7 * 24 * 3600       // How long retained processed messages are kept unless the queue says otherwise
+const defaultListLimit = 100                        // Messages returned by /messages unless a limit is given
+const maxListLimit = 1000                           // Most messages /messages returns at once
+const rateWindowSeconds = 60                        // Window over which /queue_rate averages operation rates
+const maxWaitEmptyTimeout = 10 * time.Minute        // Longest a /wait_empty request may block
+const waitEmptyCheckInterval = 1 * time.Second      // How often /wait_empty rechecks a queue when nothing wakes it
+const defaultDrainTimeout = 60                      // Seconds a drain waits for in-flight messages to be acknowledged
+const defaultHeartbeatTimeout = 30                  // Seconds a /heartbeat keeps a message leased unless the consumer asks otherwise
+const receiptAttempts = 3                           // How often a delivery receipt is tried before giving up
+const receiptRetryDelay = 2 * time.Second           // Pause before retrying a receipt, multiplied by the attempt number
+const receiptTimeout = 10 * time.Second             // How long a receipt_url may take to answer
+const maxPendingReceipts = 64                       // Receipts being sent at once; more are logged and dropped
+const maxEnqueueBatch = 1000                        // Most messages one /enqueue_batch request may carry
+const maxEnqueueBatchBody = 32 * 1024 * 1024        // Largest /enqueue_batch request body
+const requestBodyOverhead = 64 * 1024               // Room in a JSON request body beyond the base64-encoded message it may carry
+const defaultMaxBlobSize = 100                      // Default --max-blob-size in megabytes
+const defaultTargetPerConsumer = 100                // Backlog per consumer /scaling aims for unless asked otherwise
+const shutdownTimeout = 30 * time.Second            // How long a shutdown waits for requests to finish before dropping them
+const statsFlushInterval = 10 * time.Second         // How often the in-memory stats counters are written to the database
+const defaultPushTimeout = 10                       // Seconds a push_url may take to answer unless the queue says otherwise
+const pushLeaseMargin = 5                           // Seconds a pushed message stays leased beyond the push timeout
+const pushIdleInterval = 1 * time.Second            // How long a push worker waits after finding its queue empty
+const pushSyncInterval = 5 * time.Second            // How often push workers are started and stopped to match the queue configs
+const dbSizeCheckInterval = 5 * time.Second         // How often the database size is checked against --max-db-bytes
+const dbEvictionHeadroom = 10                       // Percent of --max-db-bytes background eviction keeps free, so enqueues rarely have to evict
+const dbEvictionBatch = 20                          // Messages evicted at a time while the database is over its size limit
 
 type MessageQueue struct {
-	db             *sql.DB
-	lock           sync.Mutex
-	cond           *sync.Cond
-	maxQueueLength int
-	maxMessageSize int
+	db                 *sql.DB
+	readDB             *sql.DB // Read-only connections for queries that don't take the lock; nil to read through db
+	lock               sync.Mutex
+	cond               *sync.Cond
+	maxQueueLength     int
+	maxMessageSize     int
+	gcm                cipher.AEAD            // nil when encryption at rest is disabled
+	keyring            map[string]cipher.AEAD // Per-queue encryption keys by key id, from --keyring
+	enqueueSeq         uint64                 // Bumped under lock by every enqueue so pollers can detect new messages
+	pollersLock        sync.Mutex
+	pollers            map[string]*queuePoller
+	tablePerQueue      bool            // Store each queue's messages in its own messages_<queue> table
+	cleanupLockTimeout time.Duration   // How long cleanup waits for a busy lock before skipping the run
+	tables             map[string]bool // Quoted names of the existing per-queue tables, changed under both lock and tablesLock
+	tablesLock         sync.RWMutex    // Lets queries that don't take the lock look up tables
+	tokenSecret        []byte          // Signs delete tokens when set; nil hands out plain UUIDs
+	maxInFlight        int             // Most messages leased at once across all queues; 0 for no limit
+	poisonAction       string          // What dequeue and cleanup do with poison messages, PoisonDrop or PoisonDeadLetter
+	events             *eventBroker    // Delivers queue events to /events subscribers
+	blobDir            string          // Directory holding bodies larger than maxMessageSize; empty to reject them
+	maxBlobSize        int             // Largest body stored in blobDir, in bytes
+	readOnly           bool            // The database was opened read-only, so nothing is written and cleanup doesn't run
+	tokenFormat        string          // Format of the ids in delete tokens, TokenUUIDv4, TokenUUIDv7 or TokenULID
+	maxReceives        int             // Receive count at which a message is poison
+	visibilityTimeout  int             // Visibility timeout in seconds of dequeues that don't ask for one
+	cleanupInterval    time.Duration   // Interval for running the cleanup task
+	hibernateAfter     time.Duration   // Idle time after which cleanup skips a queue; 0 to never skip
+	flushedStats       Stats           // The stats as last written to the database, changed under lock
+	done               chan struct{}   // Closed by Close to stop the background tasks
+	lengths            *lengthCache    // Cached visible counts of the queues; nil to always count
+	configs            *configCache    // Cached queue configs, invalidated whenever one is saved; nil to always read them
+	maxDBBytes         int64           // Size the database's pages may take up before messages are evicted; 0 for no limit
+	tasks              sync.WaitGroup  // The running background tasks, including push workers
+	hibernationLock    sync.Mutex
+	hibernating        map[string]bool          // Queues the last cleanup run skipped, changed under hibernationLock
+	activity           map[string]queueActivity // Per-queue counters as last seen by cleanup, changed under lock
+	pushSyncLock       sync.Mutex               // Serializes syncPushSubscriptions
+	pushLock           sync.Mutex
+	pushSubscriptions  map[string]*pushSubscription // Running push deliveries by queue name, changed under pushLock
 }
 
-type Stats struct {
-	EnqueueCount             int
-	DequeueCount             int
-	DeleteCount              int
-	GetQueueLengthCount      int
-	GetUniqueQueueNamesCount int
+// queueActivity is what cleanup last saw of a queue's counters, and when it
+// first saw them at these values.
+type queueActivity struct {
+	counters  QueueCounters
+	changedAt time.Time
 }
 
-type EnqueueRequest struct {
-	QueueName string `json:"queue_name" validate:"required,queue_name"`
-	Message   []byte `json:"message" validate:"required"`
-	Priority  int    `json:"priority"`
-}
+// Types of the events published to /events subscribers.
+const (
+	EventEnqueued     = "enqueued"
+	EventDequeued     = "dequeued"
+	EventDeleted      = "deleted"
+	EventDeadLettered = "dead_lettered"
+)
 
-type DequeueRequest struct {
-	QueueName            string `json:"queue_name" validate:"required,queue_name"`
-	VisibilityTimeout    int    `json:"visibility_timeout" validate:"omitempty"`
-	DatabasePollInterval int    `json:"database_poll_interval" validate:"omitempty,min=1,max=5"`
-}
+const eventBufferSize = 256                     // Events buffered per /events subscriber; further ones are dropped until it catches up
+const eventKeepaliveInterval = 15 * time.Second // How often an idle /events stream sends a comment to keep proxies from closing it
 
-type DeleteRequest struct {
-	DeleteToken string `json:"delete_token" validate:"required,uuid4"`
+// QueueEvent describes an operation on a message of a queue.
+type QueueEvent struct {
+	Type      string    `json:"type"`
+	QueueName string    `json:"queue_name"`
+	MessageID int64     `json:"message_id"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
-type QueueLengthRequest struct {
-	QueueName string `json:"queue_name" validate:"required,queue_name"`
+// eventSubscriber is a /events stream waiting for events of one queue.
+type eventSubscriber struct {
+	queueName string
+	types     map[string]bool // Event types to deliver; nil for all
+	events    chan QueueEvent
 }
 
-type QueueLengthResponse struct {
-	QueueName string `json:"queue_name"`
-	Count     int    `json:"count"`
+// eventBroker fans queue events out to subscribers. Publishing never blocks:
+// a subscriber whose buffer is full misses events rather than stalling queue
+// operations.
+type eventBroker struct {
+	lock        sync.Mutex
+	subscribers map[*eventSubscriber]bool
 }
 
-type UniqueQueueNamesResponse struct {
-	QueueName string `json:"queue_name"`
-	Count     int    `json:"count"`
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[*eventSubscriber]bool)}
 }
 
-type DeleteAllRequest struct {
-	QueueName string `json:"queue_name" validate:"required,queue_name"`
+func (b *eventBroker) subscribe(queueName string, types map[string]bool) *eventSubscriber {
+	subscriber := &eventSubscriber{queueName: queueName, types: types, events: make(chan QueueEvent, eventBufferSize)}
+	b.lock.Lock()
+	b.subscribers[subscriber] = true
+	b.lock.Unlock()
+	return subscriber
 }
 
-var validate *validator.Validate
-var stats Stats
-var statsLock sync.Mutex
+func (b *eventBroker) unsubscribe(subscriber *eventSubscriber) {
+	b.lock.Lock()
+	delete(b.subscribers, subscriber)
+	b.lock.Unlock()
+}
 
-func NewMessageQueue(dbFilePath string, maxQueueLength, maxMessageSize int) (*MessageQueue, error) {
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+// publish delivers an event of eventType for each of messageIDs in queueName.
+func (b *eventBroker) publish(eventType, queueName string, messageIDs ...int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.subscribers) == 0 {
+		return
 	}
 
-	mq := &MessageQueue{db: db, maxQueueLength: maxQueueLength, maxMessageSize: maxMessageSize}
-	mq.cond = sync.NewCond(&mq.lock)
-	if err := mq.initialize(); err != nil {
-		return nil, err
+	now := time.Now()
+	for subscriber := range b.subscribers {
+		if subscriber.queueName != queueName || (subscriber.types != nil && !subscriber.types[eventType]) {
+			continue
+		}
+		for _, messageID := range messageIDs {
+			select {
+			case subscriber.events <- QueueEvent{Type: eventType, QueueName: queueName, MessageID: messageID, Timestamp: now}:
+			default:
+			}
+		}
 	}
+}
 
-	// Start periodic cleanup task
-	go mq.startCleanupTask()
+// dequeueWaiter is a long-polling dequeue parked on its queue's poller.
+type dequeueWaiter struct {
+	attempt func() (bool, error) // Tries to serve the waiter, reporting whether it got a message
+	done    chan error           // Receives once the waiter has been served or has failed
+}
 
-	return mq, nil
+// queuePoller checks the database on behalf of every waiter of one queue, so
+// idle consumers cost one query per poll interval per queue rather than one
+// per consumer.
+type queuePoller struct {
+	lock     sync.Mutex
+	waiters  []*dequeueWaiter
+	interval time.Duration
 }
 
-func (mq *MessageQueue) initialize() error {
-	createTableQuery := `
-		CREATE TABLE IF NOT EXISTS messages (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			queue_name TEXT NOT NULL,
-			message BLOB NOT NULL,
-			processed INTEGER DEFAULT 0,
-			visibility_timestamp INTEGER DEFAULT 0,
-			delete_token TEXT,
-			receive_count INTEGER DEFAULT 0,
-			priority INTEGER DEFAULT 0,
-			created_at INTEGER NOT NULL
-		)
-	`
-	_, err := mq.db.Exec(createTableQuery)
-	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
-	}
-	return nil
+// lengthCache holds the visible message counts of queues, so that depth
+// checks don't have to count the queue every time. The server's own
+// enqueues and dequeues adjust a cached count; messages that become visible
+// or go away in any other way, such as expired leases, are only picked up
+// when the count is taken again after ttl.
+type lengthCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedLength
 }
 
-func (mq *MessageQueue) startCleanupTask() {
-	ticker := time.NewTicker(cleanupInterval)
-	defer ticker.Stop()
+type cachedLength struct {
+	count     int
+	countedAt time.Time
+}
 
-	for {
-		<-ticker.C
-		mq.cleanupOldMessages()
-	}
+func newLengthCache(ttl time.Duration) *lengthCache {
+	return &lengthCache{ttl: ttl, entries: make(map[string]cachedLength)}
 }
 
-func (mq *MessageQueue) cleanupOldMessages() {
-	mq.lock.Lock()
-	defer mq.lock.Unlock()
+// get returns the cached count of queueName unless it is older than ttl. A
+// nil cache never has a count.
+func (c *lengthCache) get(queueName string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	deleteStmt := `
-		DELETE FROM messages
-		WHERE receive_count > ?
-	`
-	_, err := mq.db.Exec(deleteStmt, maxReceives)
-	if err != nil {
-		log.Printf("Failed to cleanup old messages: %v", err)
+	entry, ok := c.entries[queueName]
+	if !ok || time.Since(entry.countedAt) >= c.ttl {
+		return 0, false
 	}
+	return entry.count, true
 }
 
-func (mq *MessageQueue) Enqueue(queueName string, message []byte, priority int) error {
-	mq.lock.Lock()
-	defer mq.lock.Unlock()
-
-	// Check current queue length
-	count, err := mq.getQueueLength(queueName)
-	if err != nil {
-		return fmt.Errorf("failed to get queue length: %w", err)
+// set caches count, just taken from the database, for queueName.
+func (c *lengthCache) set(queueName string, count int) {
+	if c == nil {
+		return
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[queueName] = cachedLength{count: count, countedAt: time.Now()}
+}
 
-	if count >= mq.maxQueueLength {
-		return fmt.Errorf("queue %s is full", queueName)
+// add adjusts the cached count of queueName by n, if there is one.
+func (c *lengthCache) add(queueName string, n int) {
+	if c == nil {
+		return
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	if len(message) > mq.maxMessageSize {
-		return fmt.Errorf("message size exceeds maximum limit of %d bytes", mq.maxMessageSize)
+	if entry, ok := c.entries[queueName]; ok {
+		entry.count = max(entry.count+n, 0)
+		c.entries[queueName] = entry
 	}
+}
 
-	createdAt := time.Now().UnixNano()
-	stmt, err := mq.db.Prepare("INSERT INTO messages (queue_name, message, priority, created_at) VALUES (?, ?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("failed to prepare enqueue statement: %w", err)
+// forget drops the cached count of queueName, or of every queue for "*",
+// so the next check counts again.
+func (c *lengthCache) forget(queueName string) {
+	if c == nil {
+		return
 	}
-	defer stmt.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	_, err = stmt.Exec(queueName, message, priority, createdAt)
-	if err != nil {
-		return fmt.Errorf("failed to execute enqueue statement: %w", err)
+	if queueName == "*" {
+		clear(c.entries)
+		return
 	}
+	delete(c.entries, queueName)
+}
 
-	mq.cond.Broadcast() // Signal waiting dequeue requests
-	return nil
+// configCache holds the queue configs read from the queue_config table, so
+// that every enqueue and dequeue doesn't have to read it. Whoever saves a
+// config invalidates the cache once the change is committed; gen keeps a
+// read that raced with such a change from caching the old config again.
+type configCache struct {
+	lock    sync.Mutex
+	gen     uint64
+	configs map[string]QueueConfig
 }
 
-func (mq *MessageQueue) getQueueLength(queueName string) (int, error) {
-	currentTime := time.Now().Unix()
-	stmt := "SELECT COUNT(*) AS count FROM messages WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ?"
-	row := mq.db.QueryRow(stmt, queueName, currentTime)
+func newConfigCache() *configCache {
+	return &configCache{configs: make(map[string]QueueConfig)}
+}
 
-	var count int
-	err := row.Scan(&count)
-	if err != nil {
-		return 0, fmt.Errorf("failed to scan queue length: %w", err)
+// get returns the cached config of queueName, along with the generation to
+// pass to set when it isn't cached. A nil cache never has a config.
+func (c *configCache) get(queueName string) (QueueConfig, uint64, bool) {
+	if c == nil {
+		return QueueConfig{}, 0, false
 	}
-	return count, nil
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	config, ok := c.configs[queueName]
+	return config, c.gen, ok
 }
 
-func (mq *MessageQueue) Dequeue(queueName string, visibilityTimeout, databasePollInterval int) ([]byte, string, error) {
-	// Preliminary check without locking
-	currentTime := time.Now().Unix()
-	selectStmt := `
-		SELECT id, message, receive_count FROM messages
-		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ?
-		ORDER BY priority DESC, created_at DESC, id DESC LIMIT 1
-	`
-	var id int
-	var message []byte
-	var receiveCount int
-	err := mq.db.QueryRow(selectStmt, queueName, currentTime).Scan(&id, &message, &receiveCount)
-	if err != nil && err != sql.ErrNoRows {
-		return nil, "", fmt.Errorf("failed to preliminarily select message: %w", err)
-	}
-	if err == sql.ErrNoRows {
-		// No message available, return immediately
-		return nil, "", nil
+// set caches config, read at generation gen, unless the cache has been
+// invalidated since.
+func (c *configCache) set(queueName string, config QueueConfig, gen uint64) {
+	if c == nil {
+		return
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	// Locking section for the actual dequeue operation
-	mq.lock.Lock()
-	defer mq.lock.Unlock()
-
-	if visibilityTimeout == 0 {
-		visibilityTimeout = defaultVisibilityTimeout // Default visibility timeout if not provided
-	} else if visibilityTimeout > maxVisibilityTimeout {
-		visibilityTimeout = maxVisibilityTimeout // Cap visibility timeout at 12 hours
-	} else if visibilityTimeout < 0 {
-		visibilityTimeout = 0 // Minimum visibility timeout is 0 seconds
+	if gen == c.gen {
+		c.configs[queueName] = config
 	}
+}
 
-	updateStmt := `
-		UPDATE messages
-		SET visibility_timestamp = ?, delete_token = ?, receive_count = receive_count + 1
-		WHERE id = ?
-	`
-	for {
-		tx, err := mq.db.Begin()
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to begin transaction: %w", err)
-		}
+// invalidate drops every cached config.
+func (c *configCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		err = tx.QueryRow(selectStmt, queueName, currentTime).Scan(&id, &message, &receiveCount)
-		if err != nil {
-			tx.Rollback()
-			if err == sql.ErrNoRows {
-				mq.cond.Wait() // Wait for signal from enqueue
-				continue
-			}
-			return nil, "", fmt.Errorf("failed to select message: %w", err)
-		}
+	c.gen++
+	clear(c.configs)
+}
 
-		// Check if the message has exceeded the max receive count
-		if receiveCount >= maxReceives {
-			// Handle the poison message (delete or move to special queue)
-			deleteStmt := `DELETE FROM messages WHERE id = ?`
-			_, err := tx.Exec(deleteStmt, id)
-			if err != nil {
-				tx.Rollback()
-				return nil, "", fmt.Errorf("failed to delete poison message: %w", err)
-			}
-			err = tx.Commit()
-			if err != nil {
-				return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
-			}
-			mq.cond.Broadcast()
-			continue // Retry the loop to get the next message
-		}
+// Stats holds the server's in-memory counters. Enqueue, dequeue and delete
+// counts are kept per queue in the database instead; see QueueCounters.
+type Stats struct {
+	GetQueueLengthCount      int       `json:"get_queue_length_count"`
+	GetUniqueQueueNamesCount int       `json:"get_unique_queue_names_count"`
+	ActiveConnections        int       `json:"active_connections"`
+	LastCleanupAt            time.Time `json:"last_cleanup_at"`
+	LastCleanupRowsDeleted   int       `json:"last_cleanup_rows_deleted"`
+	LastCleanupDurationMs    int64     `json:"last_cleanup_duration_ms"`
+	CleanupSkippedCount      int       `json:"cleanup_skipped_count"`
+	EvictedCount             int       `json:"evicted_count"`
+}
 
-		newVisibilityTimestamp := currentTime + int64(visibilityTimeout)
-		deleteToken := uuid.New().String()
-		_, err = tx.Exec(updateStmt, newVisibilityTimestamp, deleteToken, id)
-		if err != nil {
-			tx.Rollback()
-			return nil, "", fmt.Errorf("failed to update message: %w", err)
-		}
+// StuckMessage is a message of the highest priority pending in its queue
+// that has been in flight for longer than the queue's StuckAlertSeconds.
+type StuckMessage struct {
+	QueueName       string `json:"queue_name"`
+	MessageID       int64  `json:"message_id"`
+	Priority        int    `json:"priority"`
+	InFlightSeconds int64  `json:"in_flight_seconds"`
+}
 
-		err = tx.Commit()
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to commit transaction: %w", err)
-		}
+// StatsReport is what /stats shows and /stats.json returns.
+type StatsReport struct {
+	Stats
+	QueueCounters
+	InFlight    int            `json:"in_flight"`
+	MaxInFlight int            `json:"max_in_flight"`
+	Stuck       []StuckMessage `json:"stuck"`
+	Push        []PushStatus   `json:"push"`
+	Hibernating []string       `json:"hibernating"`
+}
 
-		return message, deleteToken, nil
-	}
+type QueueStats struct {
+	QueueName    string `json:"queue_name"`
+	EnqueueCount int    `json:"enqueue_count"`
+	DequeueCount int    `json:"dequeue_count"`
 }
 
-func (mq *MessageQueue) DeleteMessage(deleteToken string) (bool, error) {
-	mq.lock.Lock()
-	defer mq.lock.Unlock()
+// QueueCounters are the lifetime operation counts of a queue, kept in the
+// queue_stats table so they survive restarts.
+type QueueCounters struct {
+	QueueName       string `json:"queue_name,omitempty"`
+	EnqueueCount    int    `json:"enqueue_count"`
+	DequeueCount    int    `json:"dequeue_count"`
+	DeleteCount     int    `json:"delete_count"`
+	PoisonDropCount int    `json:"poison_drop_count"`
 
-	deleteStmt := "DELETE FROM messages WHERE delete_token = ?"
+	// PermanentFailureCount counts messages dead-lettered through /fail
+	PermanentFailureCount int `json:"permanent_failure_count"`
+}
 
-	tx, err := mq.db.Begin()
-	if err != nil {
-		return false, fmt.Errorf("failed to begin transaction: %w", err)
-	}
+// rateCounter counts operations in one-second buckets covering the last
+// rateWindowSeconds seconds.
+type rateCounter struct {
+	seconds [rateWindowSeconds]int64
+	counts  [rateWindowSeconds]int
+}
 
-	result, err := tx.Exec(deleteStmt, deleteToken)
-	if err != nil {
-		tx.Rollback()
-		return false, fmt.Errorf("failed to execute delete statement: %w", err)
+func (c *rateCounter) add(now int64, n int) {
+	i := now % rateWindowSeconds
+	if c.seconds[i] != now {
+		c.seconds[i] = now
+		c.counts[i] = 0
 	}
+	c.counts[i] += n
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return false, fmt.Errorf("failed to commit transaction: %w", err)
+// rate returns the average number of operations per second over the window.
+func (c *rateCounter) rate(now int64) float64 {
+	total := 0
+	for i, second := range c.seconds {
+		if second > now-rateWindowSeconds {
+			total += c.counts[i]
+		}
 	}
+	return float64(total) / rateWindowSeconds
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return false, fmt.Errorf("failed to retrieve rows affected: %w", err)
-	}
+type queueRate struct {
+	enqueues rateCounter
+	dequeues rateCounter
+}
 
-	return rowsAffected > 0, nil
+type QueueRateResponse struct {
+	QueueName     string  `json:"queue_name"`
+	WindowSeconds int     `json:"window_seconds"`
+	EnqueueRate   float64 `json:"enqueue_rate"`
+	DequeueRate   float64 `json:"dequeue_rate"`
+	NetRate       float64 `json:"net_rate"`
 }
 
-func (mq *MessageQueue) DeleteAllMessages(queueName string) error {
-	mq.lock.Lock()
-	defer mq.lock.Unlock()
+// ScalingTargets are the parameters of a /scaling recommendation. Zero
+// RatePerConsumer, TargetAgeSeconds and MaxConsumers leave that part of the
+// calculation out.
+type ScalingTargets struct {
+	TargetPerConsumer int     `json:"target_per_consumer" validate:"min=1"`
+	RatePerConsumer   float64 `json:"rate_per_consumer,omitempty" validate:"min=0"`
+	TargetAgeSeconds  int     `json:"target_age_seconds,omitempty" validate:"min=0"`
+	MinConsumers      int     `json:"min_consumers" validate:"min=0"`
+	MaxConsumers      int     `json:"max_consumers,omitempty" validate:"min=0"`
+}
 
-	var deleteStmt string
-	if queueName == "*" {
-		deleteStmt = "DELETE FROM messages"
-	} else {
-		deleteStmt = "DELETE FROM messages WHERE queue_name = ?"
-	}
+// ScalingResponse holds the metrics of a queue that matter for autoscaling
+// and the number of consumers recommended for it.
+type ScalingResponse struct {
+	QueueName        string         `json:"queue_name"`
+	Visible          int            `json:"visible"`
+	InFlight         int            `json:"in_flight"`
+	OldestAgeSeconds int64          `json:"oldest_age_seconds"`
+	EnqueueRate      float64        `json:"enqueue_rate"`
+	DequeueRate      float64        `json:"dequeue_rate"`
+	AgeExceeded      bool           `json:"age_exceeded"`
+	Targets          ScalingTargets `json:"targets"`
+	DesiredConsumers int            `json:"desired_consumers"`
+}
 
-	tx, err := mq.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+// desiredConsumers works out how many consumers the queue described by r
+// needs: enough for each to have at most TargetPerConsumer messages waiting
+// or in flight and, when RatePerConsumer is known, enough to keep up with
+// the enqueue rate while draining the visible backlog within
+// TargetAgeSeconds. The result is clamped to MinConsumers and MaxConsumers.
+func (r *ScalingResponse) desiredConsumers() int {
+	t := r.Targets
+	desired := int(math.Ceil(float64(r.Visible+r.InFlight) / float64(t.TargetPerConsumer)))
+	if t.RatePerConsumer > 0 {
+		throughput := r.EnqueueRate
+		if t.TargetAgeSeconds > 0 {
+			throughput += float64(r.Visible) / float64(t.TargetAgeSeconds)
+		}
+		desired = max(desired, int(math.Ceil(throughput/t.RatePerConsumer)))
 	}
-
-	if queueName == "*" {
-		_, err = tx.Exec(deleteStmt)
-	} else {
-		_, err = tx.Exec(deleteStmt, queueName)
+	desired = max(desired, t.MinConsumers)
+	if t.MaxConsumers > 0 {
+		desired = min(desired, t.MaxConsumers)
 	}
+	return desired
+}
 
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to execute delete statement: %w", err)
-	}
+// PositionResponse tells how far a message is from being dequeued.
+// EstimatedWaitSeconds is left out when the queue has seen no dequeues in
+// the last rateWindowSeconds.
+type PositionResponse struct {
+	QueueName            string   `json:"queue_name"`
+	MessageID            int64    `json:"message_id"`
+	Position             int      `json:"position"`
+	DequeueRate          float64  `json:"dequeue_rate"`
+	EstimatedWaitSeconds *float64 `json:"estimated_wait_seconds,omitempty"`
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
-	}
+// EnqueueResult identifies the message an enqueue stored, or the visible
+// message it was collapsed into.
+type EnqueueResult struct {
+	MessageID int64 `json:"message_id"`
+	Collapsed bool  `json:"collapsed"`
 
-	return nil
+	// Position is the message's place in dequeue order right after the
+	// enqueue, as /position reports it. Only set by Enqueue, and only while
+	// the message is visible, so not for delayed messages.
+	Position *int `json:"position,omitempty"`
 }
 
-func (mq *MessageQueue) GetQueueLength(queueName string) (int, error) {
-	mq.lock.Lock()
-	defer mq.lock.Unlock()
+type FanoutRequest struct {
+	QueueNames []string `json:"queue_names" validate:"required,min=1,max=100,unique,dive,queue_name"`
+	Message    []byte   `json:"message" validate:"required"`
+	Priority   Priority `json:"priority"`
+}
 
-	currentTime := time.Now().Unix()
-	stmt := "SELECT COUNT(*) AS count FROM messages WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ?"
-	row := mq.db.QueryRow(stmt, queueName, currentTime)
+// FanoutResult reports the outcome of a fanout enqueue for one target queue.
+type FanoutResult struct {
+	QueueName string `json:"queue_name"`
+	*EnqueueResult
+	Error string `json:"error,omitempty"`
+}
 
-	var count int
-	err := row.Scan(&count)
-	if err != nil {
-		return 0, fmt.Errorf("failed to scan queue length: %w", err)
-	}
-	return count, nil
+// EnqueueItem is one message of a batch enqueue.
+type EnqueueItem struct {
+	Message      []byte   `json:"message" validate:"required,min=1"`
+	Priority     Priority `json:"priority"`
+	DelaySeconds int      `json:"delay_seconds" validate:"min=0,max=43200"`
 }
 
-func (mq *MessageQueue) GetUniqueQueueNames() ([]UniqueQueueNamesResponse, error) {
-	mq.lock.Lock()
-	defer mq.lock.Unlock()
+type EnqueueBatchRequest struct {
+	QueueName string        `json:"queue_name" validate:"required,queue_name"`
+	Messages  []EnqueueItem `json:"messages" validate:"required,min=1,max=1000,dive"`
+}
 
-	currentTime := time.Now().Unix()
-	stmt := `
-		SELECT queue_name, COUNT(*) AS count
-		FROM messages
-		WHERE processed = 0 AND visibility_timestamp <= ?
-		GROUP BY queue_name
-	`
+type EnqueueBatchResponse struct {
+	QueueName string          `json:"queue_name"`
+	Results   []EnqueueResult `json:"results"`
+}
 
-	rows, err := mq.db.Query(stmt, currentTime)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query unique queue names: %w", err)
-	}
-	defer rows.Close()
+// QueueFullError is returned by EnqueueBatch when the batch doesn't fit into
+// the queue. Available is how many more messages the queue can take.
+type QueueFullError struct {
+	QueueName string
+	Available int
+}
 
-	var result []UniqueQueueNamesResponse
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("queue %s has room for %d more messages", e.QueueName, e.Available)
+}
 
-	for rows.Next() {
-		var queueName string
-		var count int
-		if err := rows.Scan(&queueName, &count); err != nil {
-			return nil, fmt.Errorf("failed to scan queue name and count: %w", err)
-		}
-		result = append(result, UniqueQueueNamesResponse{QueueName: queueName, Count: count})
-	}
+type QueueFullResponse struct {
+	Error     string `json:"error"`
+	Available int    `json:"available"`
+}
 
-	return result, nil
+type EnqueueRequest struct {
+	QueueName    string   `json:"queue_name" validate:"required,queue_name"`
+	Message      []byte   `json:"message" validate:"required"`
+	Priority     Priority `json:"priority"`
+	DelaySeconds int      `json:"delay_seconds" validate:"min=0,max=43200"`
 }
 
-func incrementStatsCounter(counter *int) {
-	statsLock.Lock()
-	defer statsLock.Unlock()
-	*counter++
+type DequeueRequest struct {
+	QueueName            string `json:"queue_name" validate:"required,queue_name"`
+	VisibilityTimeout    int    `json:"visibility_timeout" validate:"min=0"`
+	DatabasePollInterval int    `json:"database_poll_interval" validate:"omitempty,min=1,max=5"`
+	ConsumerGroup        string `json:"consumer_group" validate:"omitempty,queue_name"`
+	MinAvailable         int    `json:"min_available" validate:"min=0"`
+	Verbose              bool   `json:"verbose"`
+	WithQueueStats       bool   `json:"with_queue_stats"`
+	LeaseOwner           string `json:"lease_owner" validate:"max=255"`
+	ProcessingLabel      string `json:"processing_label" validate:"max=255"`
+
+	// MaxMessages above 1 leases up to that many messages at once and
+	// answers with an array of them instead of a single message.
+	MaxMessages int `json:"max_messages" validate:"min=0,max=10"`
 }
 
-func enqueueHandler(mq *MessageQueue) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		queueName := r.URL.Query().Get("queue_name")
-		priorityStr := r.URL.Query().Get("priority")
-		if queueName == "" || priorityStr == "" {
-			http.Error(w, "Missing queue_name or priority parameter", http.StatusBadRequest)
-			return
-		}
+type DequeueByIDRequest struct {
+	QueueName         string `json:"queue_name" validate:"required,queue_name"`
+	ID                int    `json:"id" validate:"required,min=1"`
+	VisibilityTimeout int    `json:"visibility_timeout" validate:"min=0"`
+	Verbose           bool   `json:"verbose"`
+	LeaseOwner        string `json:"lease_owner" validate:"max=255"`
+	ProcessingLabel   string `json:"processing_label" validate:"max=255"`
+}
 
-		priority, err := strconv.Atoi(priorityStr)
-		if err != nil {
-			http.Error(w, "Invalid priority parameter", http.StatusBadRequest)
-			return
-		}
+// ClaimAllRequest selects the visible messages of a queue for /claim_all.
+// Ages are in seconds since enqueue; a MaxAgeSeconds of 0 means no limit.
+type ClaimAllRequest struct {
+	QueueName         string `json:"queue_name" validate:"required,queue_name"`
+	VisibilityTimeout int    `json:"visibility_timeout" validate:"min=0"`
+	MinAgeSeconds     int    `json:"min_age_seconds" validate:"min=0"`
+	MaxAgeSeconds     int    `json:"max_age_seconds" validate:"min=0"`
+	Limit             int    `json:"limit" validate:"required,min=1,max=1000"`
+	LeaseOwner        string `json:"lease_owner" validate:"max=255"`
+	ProcessingLabel   string `json:"processing_label" validate:"max=255"`
+}
 
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
+// Lease is an in-flight message held by a lease owner, as listed by
+// /my_leases.
+type Lease struct {
+	QueueName       string     `json:"queue_name"`
+	MessageID       int        `json:"message_id"`
+	Message         []byte     `json:"message"`
+	DeleteToken     string     `json:"delete_token"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	LastHeartbeatAt *time.Time `json:"last_heartbeat_at,omitempty"`
+}
+
+// DequeuedMessage is a message handed out by a dequeue, together with the
+// metadata of its row. ReceiveCount includes the current delivery.
+type DequeuedMessage struct {
+	MessageID    int       `json:"message_id"`
+	Message      []byte    `json:"message"`
+	Priority     int       `json:"priority"`
+	CreatedAt    time.Time `json:"created_at"`
+	ReceiveCount int       `json:"receive_count"`
+	DeleteToken  string    `json:"delete_token"`
+
+	// Set when requested with with_queue_stats: the visible messages left in
+	// the queue after this dequeue, and the age of the oldest of them.
+	Remaining        *int   `json:"remaining,omitempty"`
+	OldestAgeSeconds *int64 `json:"oldest_age_seconds,omitempty"`
+}
+
+// response returns the body of a dequeue response: the full envelope when
+// verbose is set, otherwise just the message and its delete token, plus the
+// queue stats if they were requested.
+func (m *DequeuedMessage) response(verbose bool) interface{} {
+	if verbose {
+		return m
+	}
+	response := map[string]interface{}{"message": m.Message, "delete_token": m.DeleteToken}
+	if m.Remaining != nil {
+		response["remaining"] = *m.Remaining
+		response["oldest_age_seconds"] = *m.OldestAgeSeconds
+	}
+	return response
+}
+
+// MessageInfo describes a message listed by /messages without leasing it.
+type MessageInfo struct {
+	MessageID    int       `json:"message_id"`
+	Message      []byte    `json:"message"`
+	Priority     int       `json:"priority"`
+	CreatedAt    time.Time `json:"created_at"`
+	ReceiveCount int       `json:"receive_count"`
+	InFlight     bool      `json:"in_flight"`
+}
+
+// PeekRequest asks for the next Limit messages /dequeue would hand out.
+type PeekRequest struct {
+	QueueName string `json:"queue_name" validate:"required,queue_name"`
+	Limit     int    `json:"limit" validate:"min=0,max=100"`
+}
+
+// PeekedMessage is a message returned by /peek, which stays in the queue
+// untouched.
+type PeekedMessage struct {
+	MessageID    int       `json:"message_id"`
+	Message      []byte    `json:"message"`
+	Priority     int       `json:"priority"`
+	CreatedAt    time.Time `json:"created_at"`
+	ReceiveCount int       `json:"receive_count"`
+}
+
+// ExportedMessage is one line of the NDJSON file written by --drain-to-file.
+type ExportedMessage struct {
+	QueueName string `json:"queue_name"`
+	MessageInfo
+}
+
+// listSortColumns maps the sort_by values /messages accepts to their
+// columns. Only these ever reach the ORDER BY clause.
+var listSortColumns = map[string]string{
+	"created_at":    "created_at",
+	"priority":      "priority",
+	"receive_count": "receive_count",
+}
+
+type RemoveConsumerGroupRequest struct {
+	QueueName     string `json:"queue_name" validate:"required,queue_name"`
+	ConsumerGroup string `json:"consumer_group" validate:"required,queue_name"`
+}
+
+type DeleteRequest struct {
+	DeleteToken string `json:"delete_token" validate:"required,uuid|ulid|contains=.,max=1024"`
+}
+
+type ReleaseRequest struct {
+	DeleteToken string `json:"delete_token" validate:"required,uuid|ulid|contains=.,max=1024"`
+}
+
+type QueueLengthRequest struct {
+	QueueName        string `json:"queue_name" validate:"required,queue_name"`
+	IncludeProcessed bool   `json:"include_processed"`
+}
+
+type QueueLengthResponse struct {
+	QueueName string `json:"queue_name"`
+	Count     int    `json:"count"`
+	Delayed   int    `json:"delayed"`
+}
+
+type UniqueQueueNamesResponse struct {
+	QueueName string `json:"queue_name"`
+	Count     int    `json:"count"`
+}
+
+type QueueInfo struct {
+	QueueName        string       `json:"queue_name"`
+	Visible          int          `json:"visible"`
+	InFlight         int          `json:"in_flight"`
+	OldestAgeSeconds int64        `json:"oldest_age_seconds"`
+	Config           *QueueConfig `json:"config,omitempty"`
+}
+
+// QueueConfig holds the settings of a single queue. Zero values leave the
+// server-wide behaviour in place.
+type QueueConfig struct {
+	// Redeliveries are held back for an extra, exponentially growing delay
+	// of BackoffBaseSeconds * BackoffMultiplier^(receives-1), capped at
+	// BackoffMaxSeconds and spread by +/- BackoffJitter (a fraction).
+	BackoffBaseSeconds int     `json:"backoff_base_seconds" validate:"min=0,max=43200"`
+	BackoffMultiplier  float64 `json:"backoff_multiplier" validate:"omitempty,min=1"`
+	BackoffMaxSeconds  int     `json:"backoff_max_seconds" validate:"min=0,max=43200"`
+	BackoffJitter      float64 `json:"backoff_jitter" validate:"min=0,max=1"`
+
+	// Redeliveries stay hidden for at least RedeliveryDelaySeconds, even if
+	// the consumer asks for a shorter visibility timeout, so a short timeout
+	// for fast crash recovery doesn't turn failures into a tight retry loop.
+	RedeliveryDelaySeconds int `json:"redelivery_delay_seconds" validate:"min=0,max=43200"`
+
+	// RingCapacity turns the queue into a ring buffer holding at most this
+	// many messages: enqueueing into a full queue evicts the oldest message
+	// instead of being rejected.
+	RingCapacity int `json:"ring_capacity" validate:"min=0"`
+
+	// RetainProcessed keeps deleted messages around as processed, so they
+	// can be replayed, for RetentionSeconds (defaultRetentionSeconds if 0).
+	RetainProcessed  bool `json:"retain_processed"`
+	RetentionSeconds int  `json:"retention_seconds" validate:"min=0"`
+
+	// Once the queue holds ShedHighWaterMark visible messages, enqueues with
+	// a priority below ShedBelowPriority are rejected with ErrLoadShed.
+	ShedHighWaterMark int `json:"shed_high_water_mark" validate:"min=0"`
+	ShedBelowPriority int `json:"shed_below_priority"`
+
+	// CollapseDuplicates skips enqueueing a message whose body is identical
+	// to a message already visible in the queue.
+	CollapseDuplicates bool `json:"collapse_duplicates"`
+
+	// DeadLetterQueue names the queue that dead-lettered messages are moved
+	// to. Without one, dead-lettering isn't available for the queue.
+	DeadLetterQueue string `json:"dead_letter_queue" validate:"omitempty,queue_name"`
+
+	// A message in flight for StuckAlertSeconds while no pending message of
+	// the queue has a higher priority is reported as stuck on /stats, since
+	// the aggregate counts hide high-priority work that isn't finishing.
+	StuckAlertSeconds int `json:"stuck_alert_seconds" validate:"min=0"`
+
+	// SortKeyField names a numeric field of JSON message bodies, such as a
+	// deadline, that orders messages of the same priority, smallest first.
+	// Messages without it come after those with it.
+	SortKeyField string `json:"sort_key_field" validate:"max=256"`
+
+	// EncryptionKeyID names the key of the --keyring file that new messages
+	// of the queue are encrypted with, instead of the --encryption-key, so
+	// that tenants sharing a server don't share a key.
+	EncryptionKeyID string `json:"encryption_key_id" validate:"max=256"`
+
+	// MaxLeaseSeconds caps how long heartbeats can keep a message in flight,
+	// counted from when it was dequeued, so that a consumer hung in a
+	// heartbeat loop can't hold a message forever.
+	MaxLeaseSeconds int `json:"max_lease_seconds" validate:"min=0"`
+
+	// VisibilityJitterPercent spreads the visibility timeouts of dequeued
+	// messages by up to +/- this percentage, so messages leased together
+	// don't all become visible again at once when their consumer dies.
+	VisibilityJitterPercent int `json:"visibility_jitter_percent" validate:"min=0,max=50"`
+
+	// PushURL turns on push delivery: PushConcurrency workers (1 if 0)
+	// dequeue the queue's messages and POST each one to PushURL, deleting it
+	// once the endpoint answers 2xx within PushTimeoutSeconds
+	// (defaultPushTimeout if 0) and failing it, so it's retried with the
+	// queue's backoff, otherwise.
+	PushURL            string `json:"push_url" validate:"omitempty,http_url,max=2048"`
+	PushConcurrency    int    `json:"push_concurrency" validate:"min=0,max=64"`
+	PushTimeoutSeconds int    `json:"push_timeout_seconds" validate:"min=0,max=300"`
+
+	// MaxLength caps the number of visible messages in the queue instead of
+	// --max-queue-length, and DefaultVisibilityTimeout is used instead of
+	// --visibility-timeout for dequeues that don't give a timeout. Both fall
+	// back to the flag if 0.
+	MaxLength                int `json:"max_length" validate:"min=0"`
+	DefaultVisibilityTimeout int `json:"default_visibility_timeout" validate:"min=0,max=43200"`
+}
+
+// maxLength returns how many visible messages the queue may hold, given the
+// server-wide limit.
+func (c QueueConfig) maxLength(serverMax int) int {
+	if c.MaxLength == 0 {
+		return serverMax
+	}
+	return c.MaxLength
+}
+
+// visibilityTimeout returns the visibility timeout of a message of the queue
+// dequeued with the requested timeout, given the server-wide default. Zero
+// and negative requests get the default, and longer ones are capped at
+// maxVisibilityTimeout.
+func (c QueueConfig) visibilityTimeout(requested, serverDefault int) int {
+	if requested > 0 {
+		return min(requested, maxVisibilityTimeout)
+	}
+	if c.DefaultVisibilityTimeout > 0 {
+		return c.DefaultVisibilityTimeout
+	}
+	return serverDefault
+}
+
+// pushConcurrency returns how many push workers deliver the queue's messages.
+func (c QueueConfig) pushConcurrency() int {
+	if c.PushConcurrency == 0 {
+		return 1
+	}
+	return c.PushConcurrency
+}
+
+// pushTimeout returns how long the queue's push endpoint may take to answer.
+func (c QueueConfig) pushTimeout() time.Duration {
+	if c.PushTimeoutSeconds == 0 {
+		return defaultPushTimeout * time.Second
+	}
+	return time.Duration(c.PushTimeoutSeconds) * time.Second
+}
+
+// retention returns how long processed messages of the queue are retained.
+func (c QueueConfig) retention() time.Duration {
+	if c.RetentionSeconds == 0 {
+		return defaultRetentionSeconds * time.Second
+	}
+	return time.Duration(c.RetentionSeconds) * time.Second
+}
+
+type DeleteAllRequest struct {
+	QueueName string `json:"queue_name" validate:"required,queue_name|eq=*"`
+	DryRun    bool   `json:"dry_run"`
+}
+
+type DeleteAllDryRunResponse struct {
+	Queues []QueueLengthResponse `json:"queues"`
+	Total  int                   `json:"total"`
+}
+
+type ReprioritizeRequest struct {
+	QueueName    string    `json:"queue_name" validate:"required,queue_name"`
+	MessageIDs   []int     `json:"message_ids" validate:"omitempty,dive,min=1"`
+	FromPriority *Priority `json:"from_priority"`
+	Priority     Priority  `json:"priority"`
+}
+
+// Priority is a message priority. In JSON it may be given as a number or as
+// a string holding one, since shell and curl based clients often quote it.
+type Priority int
+
+// PriorityError reports a priority that is neither a number nor a numeric
+// string.
+type PriorityError struct {
+	Value string
+}
+
+func (e *PriorityError) Error() string {
+	return fmt.Sprintf("Invalid priority %s: must be an integer or a string holding one", e.Value)
+}
+
+func (p *Priority) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil && strings.HasPrefix(text, `"`) {
+		text = strings.TrimSpace(unquoted)
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return &PriorityError{Value: string(data)}
+	}
+	*p = Priority(n)
+	return nil
+}
+
+type ReprioritizeResponse struct {
+	QueueName string `json:"queue_name"`
+	Updated   int    `json:"updated"`
+}
+
+type ReplayRequest struct {
+	QueueName string    `json:"queue_name" validate:"required,queue_name"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+}
+
+type ReplayResponse struct {
+	QueueName string `json:"queue_name"`
+	Replayed  int    `json:"replayed"`
+}
+
+type RerouteRequest struct {
+	DeleteToken string `json:"delete_token" validate:"required,uuid|ulid|contains=.,max=1024"`
+	DestQueue   string `json:"dest_queue" validate:"required,queue_name"`
+}
+
+type RerouteResponse struct {
+	QueueName string `json:"queue_name"`
+	MessageID int64  `json:"message_id"`
+}
+
+type FailRequest struct {
+	DeleteToken string `json:"delete_token" validate:"required,uuid|ulid|contains=.,max=1024"`
+	Permanent   bool   `json:"permanent"`
+
+	// NewPriority requeues a transiently failed message with a different
+	// priority, so that failing work can be made to drift back in line.
+	NewPriority *Priority `json:"new_priority" validate:"excluded_with=Permanent"`
+}
+
+// FailResponse tells a consumer what became of the message it failed:
+// either it was dead-lettered, or it is retried in RetryInSeconds with
+// Priority.
+type FailResponse struct {
+	QueueName      string `json:"queue_name"`
+	MessageID      int64  `json:"message_id"`
+	DeadLettered   bool   `json:"dead_lettered"`
+	RetryInSeconds int    `json:"retry_in_seconds"`
+	Priority       int    `json:"priority"`
+}
+
+// ExtendVisibilityRequest hides the message leased under DeleteToken for
+// VisibilityTimeout more seconds from now.
+type ExtendVisibilityRequest struct {
+	DeleteToken       string `json:"delete_token" validate:"required,uuid|ulid|contains=.,max=1024"`
+	VisibilityTimeout int    `json:"visibility_timeout" validate:"required,min=1,max=43200"`
+}
+
+// ExtendVisibilityResponse reports a message hidden for longer by
+// /extend_visibility. DeleteToken replaces the one of the request, which
+// only changes with signed tokens.
+type ExtendVisibilityResponse struct {
+	QueueName   string    `json:"queue_name"`
+	MessageID   int       `json:"message_id"`
+	DeleteToken string    `json:"delete_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type HeartbeatRequest struct {
+	DeleteToken    string `json:"delete_token" validate:"required,uuid|ulid|contains=.,max=1024"`
+	TimeoutSeconds int    `json:"timeout_seconds" validate:"omitempty,min=1,max=43200"`
+}
+
+// Receipt is posted to the receipt_url of a message once a consumer has
+// deleted it. LatencyMs is the time from enqueue to delete.
+type Receipt struct {
+	QueueName  string    `json:"queue_name"`
+	MessageID  int64     `json:"message_id"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	LatencyMs  int64     `json:"latency_ms"`
+}
+
+// FlushResponse reports the outcome of a WAL checkpoint. LogPages and
+// CheckpointedPages are -1 when the database is not in WAL mode.
+type FlushResponse struct {
+	JournalMode       string `json:"journal_mode"`
+	Busy              bool   `json:"busy"`
+	LogPages          int    `json:"log_pages"`
+	CheckpointedPages int    `json:"checkpointed_pages"`
+}
+
+// HeartbeatResponse tells the consumer until when its lease now runs and
+// which delete token to use from now on.
+// SetLabelRequest sets the processing label of the message leased under
+// DeleteToken. An empty Label removes it.
+type SetLabelRequest struct {
+	DeleteToken string `json:"delete_token" validate:"required,uuid|ulid|contains=.,max=1024"`
+	Label       string `json:"label" validate:"max=255"`
+}
+
+type SetLabelResponse struct {
+	QueueName       string `json:"queue_name"`
+	MessageID       int    `json:"message_id"`
+	ProcessingLabel string `json:"processing_label"`
+}
+
+// InFlightMessage describes a leased message for /inflight, without its body.
+type InFlightMessage struct {
+	MessageID       int        `json:"message_id"`
+	Priority        int        `json:"priority"`
+	ReceiveCount    int        `json:"receive_count"`
+	LeasedAt        *time.Time `json:"leased_at,omitempty"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	LastHeartbeatAt *time.Time `json:"last_heartbeat_at,omitempty"`
+	LeaseOwner      string     `json:"lease_owner,omitempty"`
+	ProcessingLabel string     `json:"processing_label,omitempty"`
+}
+
+// ActiveConsumersResponse counts the consumers holding messages of a queue.
+// UnownedInFlight counts the in-flight messages dequeued without a
+// lease_owner, whose consumers can't be told apart.
+type ActiveConsumersResponse struct {
+	QueueName       string `json:"queue_name"`
+	ActiveConsumers int    `json:"active_consumers"`
+	UnownedInFlight int    `json:"unowned_in_flight"`
+}
+
+type HeartbeatResponse struct {
+	QueueName   string    `json:"queue_name"`
+	MessageID   int       `json:"message_id"`
+	DeleteToken string    `json:"delete_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// ConfigExport is the document /export_config returns and /import_config
+// accepts.
+type ConfigExport struct {
+	Queues map[string]QueueConfig `json:"queues" validate:"required"`
+}
+
+// ConfigImportResponse sorts the queues of an import by outcome. Conflicts
+// are queues that already had a different configuration; they are also
+// listed under Imported if they were overwritten.
+type ConfigImportResponse struct {
+	Imported  []string `json:"imported"`
+	Unchanged []string `json:"unchanged"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// Reasons a dequeue came back without a message, reported in the
+// X-Empty-Reason response header.
+const (
+	EmptyReasonEmpty             = "empty"               // The queue holds no pending messages
+	EmptyReasonAllDelayed        = "all_delayed"         // Every pending message is in flight, delayed or waiting out a backoff
+	EmptyReasonBelowMinAvailable = "below_min_available" // Fewer messages are visible than min_available asks for
+	EmptyReasonThrottled         = "throttled"           // The server has --max-in-flight messages leased out
+)
+
+// Actions dequeue and cleanup can take on poison messages, those received
+// --max-receives times without being deleted.
+const (
+	PoisonDrop       = "drop"
+	PoisonDeadLetter = "dead-letter"
+)
+
+// Formats of the ids in delete tokens.
+const (
+	TokenUUIDv4 = "uuidv4" // Random UUID
+	TokenUUIDv7 = "uuidv7" // UUID starting with a timestamp, so ids sort by creation
+	TokenULID   = "ulid"   // ULID, 26 characters, likewise sorting by creation
+)
+
+// Formats of the access log.
+const (
+	AccessLogJSON     = "json"     // One AccessLogEntry object per line
+	AccessLogCLF      = "clf"      // Common Log Format
+	AccessLogCombined = "combined" // Common Log Format plus referer and user agent
+)
+
+// AccessLogEntry is a line of the access log in the json format.
+type AccessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// Actions /recover_stuck can take on the stuck messages it finds.
+const (
+	RecoverCount      = "count"
+	RecoverReset      = "reset"
+	RecoverDeadLetter = "dead_letter"
+)
+
+type RecoverStuckResponse struct {
+	QueueName string `json:"queue_name"`
+	Action    string `json:"action"`
+	Affected  int    `json:"affected"`
+}
+
+// Actions /purge_poison can take on the failing messages it finds.
+const (
+	PurgeDelete     = "delete"
+	PurgeDeadLetter = "dead_letter"
+)
+
+type PurgePoisonResponse struct {
+	QueueName       string `json:"queue_name"`
+	MinReceiveCount int    `json:"min_receive_count"`
+	Action          string `json:"action"`
+	Affected        int    `json:"affected"`
+}
+
+// ServerConfig is the effective configuration the server was started with,
+// as reported by /config. Secrets are replaced by redactedValue.
+type ServerConfig struct {
+	Version                  string   `json:"version"`
+	Host                     string   `json:"host"`
+	Port                     string   `json:"port"`
+	DatabasePath             string   `json:"database_path"`
+	MaxQueueLength           int      `json:"max_queue_length"`
+	MaxMessageSize           int      `json:"max_message_size"`
+	MaxConnections           int      `json:"max_connections"`
+	MaxInFlight              int      `json:"max_in_flight"`
+	ReadConnections          int      `json:"read_connections"`
+	SQLiteParams             string   `json:"sqlite_params"`
+	MaxLongPollsPerQueue     int      `json:"max_long_polls_per_queue"`
+	EncryptionKey            string   `json:"encryption_key"`
+	Keyring                  string   `json:"keyring"`
+	TokenSecret              string   `json:"token_secret"`
+	TokenFormat              string   `json:"token_format"`
+	TLSCertFile              string   `json:"tls_cert_file"`
+	TLSKeyFile               string   `json:"tls_key_file"`
+	TLSClientCAFile          string   `json:"tls_client_ca_file"`
+	NormalizeQueueNames      bool     `json:"normalize_queue_names"`
+	StrictJSON               bool     `json:"strict_json"`
+	EnqueueAccepted          bool     `json:"enqueue_accepted"`
+	RequireUTF8              bool     `json:"require_utf8"`
+	ReadOnly                 bool     `json:"read_only"`
+	AccessLogFormat          string   `json:"access_log_format"`
+	RecoverInFlight          bool     `json:"recover_in_flight"`
+	TablePerQueue            bool     `json:"table_per_queue"`
+	DefaultVisibilityTimeout int      `json:"default_visibility_timeout"`
+	MaxVisibilityTimeout     int      `json:"max_visibility_timeout"`
+	MaxReceives              int      `json:"max_receives"`
+	CleanupIntervalSeconds   int      `json:"cleanup_interval_seconds"`
+	HibernateAfterSeconds    int      `json:"hibernate_after_seconds"`
+	QueueLengthCacheSeconds  int      `json:"queue_length_cache_seconds"`
+	MaxDBBytes               int64    `json:"max_db_bytes"`
+	CleanupLockTimeoutMs     int      `json:"cleanup_lock_timeout_ms"`
+	PoisonAction             string   `json:"poison_action"`
+	BlobDir                  string   `json:"blob_dir"`
+	MaxBlobSize              int      `json:"max_blob_size"`
+	LongPollTimeoutSeconds   int      `json:"long_poll_timeout_seconds"`
+	WriteTimeoutSeconds      int      `json:"write_timeout_seconds"`
+	DrainToFile              string   `json:"drain_to_file"`
+	DrainTimeoutSeconds      int      `json:"drain_timeout_seconds"`
+	CallbackHosts            []string `json:"callback_hosts"`
+	CallbackAllowPrivate     bool     `json:"callback_allow_private"`
+	DisabledEndpoints        []string `json:"disabled_endpoints"`
+}
+
+const redactedValue = "[REDACTED]"
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// ErrLeaseExpired is returned by Heartbeat when the lease of the message ran
+// out before the heartbeat arrived, so it may already be redelivered.
+var ErrLeaseExpired = errors.New("lease has expired")
+
+// ErrLeaseCapReached is returned by Heartbeat and ChangeVisibility when the
+// message has been in flight for its queue's max_lease_seconds. The lease is
+// ended, so the message can be redelivered.
+var ErrLeaseCapReached = errors.New("lease has reached the queue's max_lease_seconds")
+
+// ErrSameQueue is returned by Reroute when a message is to be moved to the
+// queue it is already in.
+var ErrSameQueue = errors.New("message is already in the destination queue")
+
+// Returned by DequeueByID when the requested message can't be leased.
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrMessageInFlight = errors.New("message is in flight")
+)
+
+// ErrNoDeadLetterQueue is returned when messages of a queue without a
+// dead_letter_queue setting are to be dead-lettered.
+var ErrNoDeadLetterQueue = errors.New("queue has no dead letter queue configured")
+
+// Returned by DeleteMessage for signed delete tokens that fail verification.
+var (
+	ErrInvalidDeleteToken = errors.New("invalid delete token")
+	ErrDeleteTokenExpired = errors.New("delete token has expired")
+)
+
+// ErrInFlightLimit is returned by the dequeue methods when the server already
+// has maxInFlight messages leased out.
+var ErrInFlightLimit = errors.New("too many messages in flight")
+
+// ErrLoadShed is returned by Enqueue when a low-priority message is turned
+// away because its queue is past its high-water mark.
+var ErrLoadShed = errors.New("queue is shedding load")
+
+// ErrDatabaseFull is returned by the enqueue methods when the database has
+// reached maxDBBytes and evicting messages can't make room.
+var ErrDatabaseFull = errors.New("database is full")
+
+var validate *validator.Validate
+var normalizeQueueNames bool
+var strictJSON bool      // Reject JSON request bodies with fields the endpoint doesn't know
+var enqueueAccepted bool // Answer enqueues with 202 Accepted and the message's Location
+var requireUTF8 bool     // Reject raw /enqueue bodies that aren't valid UTF-8 unless binary=true is given
+var stats Stats
+var queueStats = make(map[string]*QueueStats)
+var queueRates = make(map[string]*queueRate)
+var statsLock sync.Mutex
+
+// MessageQueueOptions are the settings of a MessageQueue, mostly taken
+// from the command-line flags of the same names. Zero values turn the
+// optional features off.
+type MessageQueueOptions struct {
+	MaxQueueLength     int
+	MaxMessageSize     int
+	EncryptionKey      []byte            // Key for encryption at rest; nil to store messages in plain text
+	Keyring            map[string][]byte // Per-queue encryption keys by key id
+	TablePerQueue      bool
+	CleanupLockTimeout time.Duration
+	CleanupInterval    time.Duration
+	TokenSecret        []byte // Secret for signed delete tokens; nil for random ones
+	TokenFormat        string
+	RecoverInFlight    bool
+	MaxInFlight        int
+	PoisonAction       string
+	ReadConnections    int
+	BlobDir            string
+	MaxBlobSize        int
+	ReadOnly           bool
+	MaxReceives        int
+	VisibilityTimeout  int // Seconds
+	HibernateAfter     time.Duration
+	LengthCacheTTL     time.Duration
+	MaxDBBytes         int64  // Bounds the database pages only, not the write-ahead log or BlobDir
+	SQLiteParams       string // Extra DSN parameters, as validated by parseSQLiteParams
+}
+
+// parseSQLiteParams checks the value of --sqlite-params, a URL query string
+// such as "_journal_mode=WAL&_busy_timeout=5000" with an optional leading
+// "?", and returns it without the "?". mode is left to --read-only and
+// --memory, which set it themselves.
+func parseSQLiteParams(params string) (string, error) {
+	params = strings.TrimPrefix(params, "?")
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return "", fmt.Errorf("sqlite-params is not a valid query string: %w", err)
+	}
+	for key := range values {
+		if key == "" {
+			return "", fmt.Errorf("sqlite-params has a value without a name")
+		}
+		if key == "mode" {
+			return "", fmt.Errorf("sqlite-params cannot set mode, use --read-only or --memory instead")
+		}
+	}
+	return params, nil
+}
+
+// sqliteDSN returns the data source name to open dbFilePath with. Any
+// parameters turn it into a "file:" URI, since the driver only hands URI
+// parameters such as cache=shared on to SQLite for those.
+func sqliteDSN(dbFilePath string, readOnly bool, params string) string {
+	var query []string
+	if readOnly {
+		query = append(query, "mode=ro")
+	}
+	if params != "" {
+		query = append(query, params)
+	}
+	if len(query) == 0 {
+		return dbFilePath
+	}
+	return "file:" + dbFilePath + "?" + strings.Join(query, "&")
+}
+
+func NewMessageQueue(dbFilePath string, opts MessageQueueOptions) (*MessageQueue, error) {
+	readOnly := opts.ReadOnly
+	db, err := sql.Open("sqlite3", sqliteDSN(dbFilePath, readOnly, opts.SQLiteParams))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// Every connection to ":memory:" opens a database of its own, so the pool
+	// must hold exactly one, which lock-free reads then wait for
+	if dbFilePath == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
+	mq := &MessageQueue{db: db, maxQueueLength: opts.MaxQueueLength, maxMessageSize: opts.MaxMessageSize, pollers: make(map[string]*queuePoller), tablePerQueue: opts.TablePerQueue, tables: make(map[string]bool), cleanupLockTimeout: opts.CleanupLockTimeout, tokenSecret: opts.TokenSecret, maxInFlight: opts.MaxInFlight, poisonAction: opts.PoisonAction, events: newEventBroker(), blobDir: opts.BlobDir, maxBlobSize: opts.MaxBlobSize, readOnly: readOnly, tokenFormat: opts.TokenFormat, maxReceives: opts.MaxReceives, visibilityTimeout: opts.VisibilityTimeout, cleanupInterval: opts.CleanupInterval, hibernateAfter: opts.HibernateAfter, activity: make(map[string]queueActivity), pushSubscriptions: make(map[string]*pushSubscription), done: make(chan struct{}), maxDBBytes: opts.MaxDBBytes}
+	if opts.LengthCacheTTL > 0 {
+		mq.lengths = newLengthCache(opts.LengthCacheTTL)
+	}
+	// A read-only server may be serving a database another server writes
+	// to, whose config changes it would never hear about
+	if !readOnly {
+		mq.configs = newConfigCache()
+	}
+	mq.cond = sync.NewCond(&mq.lock)
+	if opts.EncryptionKey != nil {
+		block, err := aes.NewCipher(opts.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		mq.gcm, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize encryption: %w", err)
+		}
+	}
+	mq.keyring = make(map[string]cipher.AEAD, len(opts.Keyring))
+	for keyID, key := range opts.Keyring {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %s: %w", keyID, err)
+		}
+		mq.keyring[keyID], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize encryption: %w", err)
+		}
+	}
+	if err := mq.initialize(); err != nil {
+		return nil, err
+	}
+
+	// Opened after initialize so that the database file and tables exist
+	if opts.ReadConnections > 0 {
+		mq.readDB, err = sql.Open("sqlite3", sqliteDSN(dbFilePath, true, opts.SQLiteParams))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open read-only database: %w", err)
+		}
+		mq.readDB.SetMaxOpenConns(opts.ReadConnections)
+	}
+
+	if opts.RecoverInFlight {
+		recovered, err := mq.recoverInFlightMessages()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Recovered %d in-flight messages left over from the previous run", recovered)
+	}
+
+	// Start periodic cleanup task
+	if !readOnly {
+		mq.tasks.Add(3)
+		go mq.startCleanupTask()
+		go mq.startStatsFlushTask()
+		go mq.startPushTask()
+		if opts.MaxDBBytes > 0 {
+			mq.tasks.Add(1)
+			go mq.startEvictionTask()
+		}
+	}
+
+	return mq, nil
+}
+
+// recoverInFlightMessages makes every in-flight message visible again. The
+// consumers that leased them can't have survived a restart, so there is no
+// point in waiting for their visibility timeouts. Delayed messages, which
+// were never received, keep their delay.
+func (mq *MessageQueue) recoverInFlightMessages() (int, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	now := time.Now().Unix()
+	var recovered int64
+	for _, table := range mq.messageTables() {
+		result, err := tx.Exec("UPDATE "+table+" SET visibility_timestamp = 0, delete_token = NULL, lease_owner = NULL WHERE processed = 0 AND visibility_timestamp > ? AND receive_count > 0", now)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to recover in-flight messages: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to retrieve rows affected: %w", err)
+		}
+		recovered += rowsAffected
+	}
+
+	result, err := tx.Exec("UPDATE group_deliveries SET visibility_timestamp = 0, delete_token = NULL WHERE acked = 0 AND visibility_timestamp > ?", now)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to recover in-flight group deliveries: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to retrieve rows affected: %w", err)
+	}
+	recovered += rowsAffected
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return int(recovered), nil
+}
+
+func (mq *MessageQueue) initialize() error {
+	// Opening the database is lazy, so without this check a database that
+	// can't be written would only fail on the first enqueue
+	if !mq.readOnly {
+		if err := mq.checkWritable(); err != nil {
+			return err
+		}
+	}
+
+	if mq.tablePerQueue {
+		rows, err := mq.db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'messages\_%' ESCAPE '\'`)
+		if err != nil {
+			return fmt.Errorf("failed to list queue tables: %w", err)
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan queue table name: %w", err)
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+
+		for _, name := range names {
+			table := quoteTableName(name)
+			if err := mq.createMessageTable(table); err != nil {
+				return err
+			}
+			mq.tablesLock.Lock()
+			mq.tables[table] = true
+			mq.tablesLock.Unlock()
+		}
+	} else if err := mq.createMessageTable("messages"); err != nil {
+		return err
+	}
+
+	createGroupTablesQuery := `
+		CREATE TABLE IF NOT EXISTS consumer_groups (
+			queue_name TEXT NOT NULL,
+			group_name TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (queue_name, group_name)
+		);
+		CREATE TABLE IF NOT EXISTS group_deliveries (
+			queue_name TEXT NOT NULL,
+			group_name TEXT NOT NULL,
+			message_id INTEGER NOT NULL,
+			visibility_timestamp INTEGER DEFAULT 0,
+			delete_token TEXT,
+			receive_count INTEGER DEFAULT 0,
+			acked INTEGER DEFAULT 0,
+			PRIMARY KEY (queue_name, group_name, message_id)
+		);
+		CREATE INDEX IF NOT EXISTS group_deliveries_delete_token ON group_deliveries (delete_token);
+		CREATE INDEX IF NOT EXISTS group_deliveries_visibility ON group_deliveries (visibility_timestamp);
+	`
+	_, err := mq.db.Exec(createGroupTablesQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer group tables: %w", err)
+	}
+
+	createConfigTableQuery := `
+		CREATE TABLE IF NOT EXISTS queue_config (
+			queue_name TEXT PRIMARY KEY,
+			config TEXT NOT NULL,
+			updated_at INTEGER NOT NULL
+		)
+	`
+	_, err = mq.db.Exec(createConfigTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create queue config table: %w", err)
+	}
+
+	createStatsTableQuery := `
+		CREATE TABLE IF NOT EXISTS queue_stats (
+			queue_name TEXT PRIMARY KEY,
+			enqueue_count INTEGER NOT NULL DEFAULT 0,
+			dequeue_count INTEGER NOT NULL DEFAULT 0,
+			delete_count INTEGER NOT NULL DEFAULT 0,
+			poison_drop_count INTEGER NOT NULL DEFAULT 0,
+			permanent_failure_count INTEGER NOT NULL DEFAULT 0
+		)
+	`
+	_, err = mq.db.Exec(createStatsTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create queue stats table: %w", err)
+	}
+	if err := mq.addColumnIfMissing("queue_stats", "permanent_failure_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	createServerStatsTableQuery := `
+		CREATE TABLE IF NOT EXISTS stats (
+			name TEXT PRIMARY KEY,
+			value INTEGER NOT NULL
+		)
+	`
+	_, err = mq.db.Exec(createServerStatsTableQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create stats table: %w", err)
+	}
+	return mq.loadStats()
+}
+
+// persistedStats returns the counters of s that survive restarts, by their
+// name in the stats table. The others describe the running server.
+func persistedStats(s *Stats) map[string]*int {
+	return map[string]*int{
+		"get_queue_length_count":       &s.GetQueueLengthCount,
+		"get_unique_queue_names_count": &s.GetUniqueQueueNamesCount,
+		"cleanup_skipped_count":        &s.CleanupSkippedCount,
+		"evicted_count":                &s.EvictedCount,
+	}
+}
+
+// loadStats sets the in-memory stats counters to the values last flushed to
+// the stats table.
+func (mq *MessageQueue) loadStats() error {
+	rows, err := mq.db.Query("SELECT name, value FROM stats")
+	if err != nil {
+		return fmt.Errorf("failed to query stats: %w", err)
+	}
+	defer rows.Close()
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	counters := persistedStats(&stats)
+	for rows.Next() {
+		var name string
+		var value int
+		if err := rows.Scan(&name, &value); err != nil {
+			return fmt.Errorf("failed to scan stats: %w", err)
+		}
+		if counter, ok := counters[name]; ok {
+			*counter = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read stats: %w", err)
+	}
+	mq.flushedStats = stats
+	return nil
+}
+
+// startStatsFlushTask writes the stats counters to the database every
+// statsFlushInterval, so requests only pay for an in-memory increment.
+func (mq *MessageQueue) startStatsFlushTask() {
+	defer mq.tasks.Done()
+
+	for mq.sleep(statsFlushInterval) {
+		if err := mq.FlushStats(); err != nil {
+			log.Printf("Failed to flush stats: %v", err)
+		}
+	}
+}
+
+// FlushStats writes the stats counters that changed since the last flush to
+// the stats table. Call it on shutdown, so that no counts are lost.
+func (mq *MessageQueue) FlushStats() error {
+	if mq.readOnly {
+		return nil
+	}
+
+	statsLock.Lock()
+	snapshot := stats
+	statsLock.Unlock()
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	flushed := persistedStats(&mq.flushedStats)
+	for name, counter := range persistedStats(&snapshot) {
+		if *counter == *flushed[name] {
+			continue
+		}
+		upsertStmt := "INSERT INTO stats (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value"
+		if _, err := tx.Exec(upsertStmt, name, *counter); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to save stats: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mq.flushedStats = snapshot
+	return nil
+}
+
+// loadKeyring reads a keyring file, a JSON object mapping key ids to
+// hex-encoded AES keys.
+func loadKeyring(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	var hexKeys map[string]string
+	if err := json.Unmarshal(data, &hexKeys); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %w", err)
+	}
+	keyring := make(map[string][]byte, len(hexKeys))
+	for keyID, hexKey := range hexKeys {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %s of keyring must be hex encoded: %w", keyID, err)
+		}
+		keyring[keyID] = key
+	}
+	return keyring, nil
+}
+
+// checkWritable makes a write to the database and rolls it back, to find out
+// whether the database file and its directory can be written.
+func (mq *MessageQueue) checkWritable() error {
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("CREATE TABLE sasquatch_write_check (id INTEGER)"); err != nil {
+		return fmt.Errorf("database is not writable, check the permissions of the database file and its directory or start with --read-only: %w", err)
+	}
+	return nil
+}
+
+// createMessageTable creates a table holding messages, or brings an existing
+// one up to date.
+func (mq *MessageQueue) createMessageTable(table string) error {
+	createTableQuery := `
+		CREATE TABLE IF NOT EXISTS %s (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			queue_name TEXT NOT NULL,
+			message BLOB NOT NULL,
+			processed INTEGER DEFAULT 0,
+			visibility_timestamp INTEGER DEFAULT 0,
+			delete_token TEXT,
+			receive_count INTEGER DEFAULT 0,
+			priority INTEGER DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			encrypted INTEGER DEFAULT 0,
+			nonce BLOB,
+			processed_at INTEGER,
+			body_hash TEXT,
+			lease_owner TEXT,
+			last_heartbeat_at INTEGER,
+			receipt_url TEXT,
+			blob_ref TEXT,
+			dedup_id TEXT,
+			leased_at INTEGER,
+			processing_label TEXT,
+			sort_key REAL,
+			key_id TEXT
+		)
+	`
+	_, err := mq.db.Exec(fmt.Sprintf(createTableQuery, table))
+	if err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	// Databases created by older versions lack the newer columns
+	if err := mq.addColumnIfMissing(table, "encrypted", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "nonce", "BLOB"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "processed_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "body_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "lease_owner", "TEXT"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "last_heartbeat_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "receipt_url", "TEXT"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "blob_ref", "TEXT"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "dedup_id", "TEXT"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "leased_at", "INTEGER"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "processing_label", "TEXT"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "sort_key", "REAL"); err != nil {
+		return err
+	}
+	if err := mq.addColumnIfMissing(table, "key_id", "TEXT"); err != nil {
+		return err
+	}
+
+	// Queue names are restricted to [a-zA-Z0-9-_], so the table name can be
+	// unquoted to build the index name
+	index := quoteTableName(strings.Trim(table, `"`) + "_body_hash")
+	_, err = mq.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (queue_name, body_hash)", index, table))
+	if err != nil {
+		return fmt.Errorf("failed to create body hash index: %w", err)
+	}
+
+	index = quoteTableName(strings.Trim(table, `"`) + "_dedup_id")
+	_, err = mq.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (queue_name, dedup_id)", index, table))
+	if err != nil {
+		return fmt.Errorf("failed to create dedup id index: %w", err)
+	}
+
+	index = quoteTableName(strings.Trim(table, `"`) + "_sort_key")
+	_, err = mq.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (queue_name, priority, sort_key)", index, table))
+	if err != nil {
+		return fmt.Errorf("failed to create sort key index: %w", err)
+	}
+
+	// Lets in-flight messages be counted without scanning visible ones
+	index = quoteTableName(strings.Trim(table, `"`) + "_visibility")
+	_, err = mq.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (visibility_timestamp)", index, table))
+	if err != nil {
+		return fmt.Errorf("failed to create visibility index: %w", err)
+	}
+
+	// Acks look unsigned delete tokens up in every message table
+	index = quoteTableName(strings.Trim(table, `"`) + "_delete_token")
+	_, err = mq.db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (delete_token)", index, table))
+	if err != nil {
+		return fmt.Errorf("failed to create delete token index: %w", err)
+	}
+	return nil
+}
+
+func quoteTableName(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// messageTable returns the table holding the messages of queueName and
+// whether it exists. In table-per-queue mode a queue's table only exists once
+// something has been enqueued into it; a missing table is an empty queue.
+// Without the lock held the table may be dropped right after the lookup,
+// see isMissingTable.
+func (mq *MessageQueue) messageTable(queueName string) (string, bool) {
+	if !mq.tablePerQueue {
+		return "messages", true
+	}
+	table := quoteTableName("messages_" + queueName)
+	mq.tablesLock.RLock()
+	defer mq.tablesLock.RUnlock()
+	return table, mq.tables[table]
+}
+
+// messageTables returns every table holding messages. Like messageTable it
+// can be called without the lock.
+func (mq *MessageQueue) messageTables() []string {
+	if !mq.tablePerQueue {
+		return []string{"messages"}
+	}
+	mq.tablesLock.RLock()
+	defer mq.tablesLock.RUnlock()
+	tables := make([]string, 0, len(mq.tables))
+	for table := range mq.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// isMissingTable reports whether err comes from querying a table that no
+// longer exists. Queries that run without the lock can race with a queue's
+// table being dropped in table-per-queue mode, and treat that as an empty
+// queue.
+func isMissingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table")
+}
+
+// reader returns the handle for read-only queries made without taking the
+// lock, so that monitoring doesn't wait behind queue operations. They rely
+// on SQLite to only show them committed data.
+func (mq *MessageQueue) reader() *sql.DB {
+	if mq.readDB != nil {
+		return mq.readDB
+	}
+	return mq.db
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx. Reads made while a
+// transaction is open must go through the transaction: an in-memory
+// database has a single connection, which the transaction holds.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// addQueueCounter adds n to counter, a column of queue_stats, for queueName.
+// Counters are updated in the transaction of the operation they count, so
+// they can't drift from what actually happened.
+func addQueueCounter(e execer, queueName, counter string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	upsertStmt := `
+		INSERT INTO queue_stats (queue_name, ` + counter + `) VALUES (?, ?)
+		ON CONFLICT (queue_name) DO UPDATE SET ` + counter + ` = ` + counter + ` + excluded.` + counter
+	_, err := e.Exec(upsertStmt, queueName, n)
+	if err != nil {
+		return fmt.Errorf("failed to update queue stats: %w", err)
+	}
+	return nil
+}
+
+// GetQueueCounters returns the lifetime counters of queueName.
+func (mq *MessageQueue) GetQueueCounters(queueName string) (QueueCounters, error) {
+	db := mq.reader()
+
+	counters := QueueCounters{QueueName: queueName}
+	selectStmt := "SELECT enqueue_count, dequeue_count, delete_count, poison_drop_count, permanent_failure_count FROM queue_stats WHERE queue_name = ?"
+	err := db.QueryRow(selectStmt, queueName).Scan(&counters.EnqueueCount, &counters.DequeueCount, &counters.DeleteCount, &counters.PoisonDropCount, &counters.PermanentFailureCount)
+	if err != nil && err != sql.ErrNoRows {
+		return QueueCounters{}, fmt.Errorf("failed to read queue stats: %w", err)
+	}
+	return counters, nil
+}
+
+// GetTotalCounters sums the lifetime counters of all queues.
+func (mq *MessageQueue) GetTotalCounters() (QueueCounters, error) {
+	db := mq.reader()
+
+	var counters QueueCounters
+	selectStmt := "SELECT COALESCE(SUM(enqueue_count), 0), COALESCE(SUM(dequeue_count), 0), COALESCE(SUM(delete_count), 0), COALESCE(SUM(poison_drop_count), 0), COALESCE(SUM(permanent_failure_count), 0) FROM queue_stats"
+	err := db.QueryRow(selectStmt).Scan(&counters.EnqueueCount, &counters.DequeueCount, &counters.DeleteCount, &counters.PoisonDropCount, &counters.PermanentFailureCount)
+	if err != nil {
+		return QueueCounters{}, fmt.Errorf("failed to read queue stats: %w", err)
+	}
+	return counters, nil
+}
+
+// GetAllQueueCounters returns the lifetime counters of every queue that has
+// any, sorted by queue name.
+func (mq *MessageQueue) GetAllQueueCounters() ([]QueueCounters, error) {
+	db := mq.reader()
+
+	return allQueueCounters(db)
+}
+
+func allQueueCounters(db *sql.DB) ([]QueueCounters, error) {
+	selectStmt := "SELECT queue_name, enqueue_count, dequeue_count, delete_count, poison_drop_count, permanent_failure_count FROM queue_stats ORDER BY queue_name"
+	rows, err := db.Query(selectStmt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query queue stats: %w", err)
+	}
+	defer rows.Close()
+
+	var all []QueueCounters
+	for rows.Next() {
+		var counters QueueCounters
+		if err := rows.Scan(&counters.QueueName, &counters.EnqueueCount, &counters.DequeueCount, &counters.DeleteCount, &counters.PoisonDropCount, &counters.PermanentFailureCount); err != nil {
+			return nil, fmt.Errorf("failed to scan queue stats: %w", err)
+		}
+		all = append(all, counters)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read queue stats: %w", err)
+	}
+	return all, nil
+}
+
+// inFlightCount returns how many messages are leased out across all queues,
+// counting each consumer group delivery separately. Thanks to the visibility
+// indexes this costs time proportional to the in-flight messages, which
+// maxInFlight keeps bounded.
+func (mq *MessageQueue) inFlightCount(q querier) (int, error) {
+	now := time.Now().Unix()
+	total := 0
+	for _, table := range mq.messageTables() {
+		var count int
+		err := q.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE visibility_timestamp > ? AND receive_count > 0 AND processed = 0", now).Scan(&count)
+		if isMissingTable(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to count in-flight messages: %w", err)
+		}
+		total += count
+	}
+
+	var count int
+	err := q.QueryRow("SELECT COUNT(*) FROM group_deliveries WHERE visibility_timestamp > ? AND acked = 0", now).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count in-flight group deliveries: %w", err)
+	}
+	return total + count, nil
+}
+
+// checkInFlightLimit returns ErrInFlightLimit if leasing out another message
+// would exceed maxInFlight.
+func (mq *MessageQueue) checkInFlightLimit(q querier) error {
+	if mq.maxInFlight == 0 {
+		return nil
+	}
+	count, err := mq.inFlightCount(q)
+	if err != nil {
+		return err
+	}
+	if count >= mq.maxInFlight {
+		return ErrInFlightLimit
+	}
+	return nil
+}
+
+// Flush checkpoints the write-ahead log into the main database file and
+// truncates it, for example before taking a backup. Holding the lock keeps
+// the server's own writers out of the way while it runs.
+func (mq *MessageQueue) Flush() (FlushResponse, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	var response FlushResponse
+	if err := mq.db.QueryRow("PRAGMA journal_mode").Scan(&response.JournalMode); err != nil {
+		return response, fmt.Errorf("failed to read journal mode: %w", err)
+	}
+
+	var busy int
+	err := mq.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &response.LogPages, &response.CheckpointedPages)
+	if err != nil {
+		return response, fmt.Errorf("failed to checkpoint: %w", err)
+	}
+	response.Busy = busy != 0
+	return response, nil
+}
+
+// GetInFlightCount returns how many messages are leased out across all queues.
+func (mq *MessageQueue) GetInFlightCount() (int, error) {
+	db := mq.reader()
+
+	return mq.inFlightCount(db)
+}
+
+// GetQueueConfig returns the configuration of queueName, or the zero config
+// if none has been set.
+func (mq *MessageQueue) GetQueueConfig(queueName string) (QueueConfig, error) {
+	return mq.queueConfig(mq.db, queueName)
+}
+
+// queueConfig returns the configuration of queueName from the config cache,
+// reading it through q if it isn't cached yet.
+func (mq *MessageQueue) queueConfig(q querier, queueName string) (QueueConfig, error) {
+	config, gen, ok := mq.configs.get(queueName)
+	if ok {
+		return config, nil
+	}
+	config, err := getQueueConfig(q, queueName)
+	if err != nil {
+		return config, err
+	}
+	mq.configs.set(queueName, config, gen)
+	return config, nil
+}
+
+func getQueueConfig(q querier, queueName string) (QueueConfig, error) {
+	var config QueueConfig
+	var data string
+	err := q.QueryRow("SELECT config FROM queue_config WHERE queue_name = ?", queueName).Scan(&data)
+	if err == sql.ErrNoRows {
+		return config, nil
+	}
+	if err != nil {
+		return config, fmt.Errorf("failed to read queue config: %w", err)
+	}
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return config, fmt.Errorf("failed to decode queue config: %w", err)
+	}
+	return config, nil
+}
+
+// SetQueueConfig replaces the configuration of queueName. The queue does not
+// need to hold any messages.
+func (mq *MessageQueue) SetQueueConfig(queueName string, config QueueConfig) error {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	defer mq.configs.invalidate()
+
+	return saveQueueConfig(mq.db, queueName, config)
+}
+
+func saveQueueConfig(e execer, queueName string, config QueueConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode queue config: %w", err)
+	}
+
+	upsertStmt := `
+		INSERT INTO queue_config (queue_name, config, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (queue_name) DO UPDATE SET config = excluded.config, updated_at = excluded.updated_at
+	`
+	_, err = e.Exec(upsertStmt, queueName, string(data), time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to save queue config: %w", err)
+	}
+	return nil
+}
+
+// ExportQueueConfigs returns the configuration of every configured queue.
+func (mq *MessageQueue) ExportQueueConfigs() (map[string]QueueConfig, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	rows, err := mq.db.Query("SELECT queue_name, config FROM queue_config")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query queue configs: %w", err)
+	}
+	defer rows.Close()
+
+	configs := make(map[string]QueueConfig)
+	for rows.Next() {
+		var queueName, data string
+		if err := rows.Scan(&queueName, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan queue config: %w", err)
+		}
+		var config QueueConfig
+		if err := json.Unmarshal([]byte(data), &config); err != nil {
+			return nil, fmt.Errorf("failed to decode queue config: %w", err)
+		}
+		configs[queueName] = config
+	}
+	return configs, rows.Err()
+}
+
+// ImportQueueConfigs applies configs in one transaction. A queue that already
+// has a different configuration is a conflict: it is only replaced if
+// overwrite is set, and otherwise left alone and reported.
+func (mq *MessageQueue) ImportQueueConfigs(configs map[string]QueueConfig, overwrite bool) (ConfigImportResponse, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	queueNames := make([]string, 0, len(configs))
+	for queueName := range configs {
+		queueNames = append(queueNames, queueName)
+	}
+	sort.Strings(queueNames)
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return ConfigImportResponse{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	response := ConfigImportResponse{Imported: []string{}, Unchanged: []string{}, Conflicts: []string{}}
+	for _, queueName := range queueNames {
+		config := configs[queueName]
+		existing, err := getQueueConfig(tx, queueName)
+		if err != nil {
+			tx.Rollback()
+			return ConfigImportResponse{}, err
+		}
+
+		if existing == config {
+			response.Unchanged = append(response.Unchanged, queueName)
+			continue
+		}
+		if existing != (QueueConfig{}) {
+			response.Conflicts = append(response.Conflicts, queueName)
+			if !overwrite {
+				continue
+			}
+		}
+
+		if err := saveQueueConfig(tx, queueName, config); err != nil {
+			tx.Rollback()
+			return ConfigImportResponse{}, err
+		}
+		response.Imported = append(response.Imported, queueName)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return ConfigImportResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mq.configs.invalidate()
+	return response, nil
+}
+
+// retryBackoff returns how many extra seconds a message that has already been
+// received receiveCount times is kept hidden on its next delivery.
+func (c QueueConfig) retryBackoff(receiveCount int) int {
+	if c.BackoffBaseSeconds == 0 || receiveCount == 0 {
+		return 0
+	}
+
+	multiplier := c.BackoffMultiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	backoff := float64(c.BackoffBaseSeconds) * math.Pow(multiplier, float64(receiveCount-1))
+	backoff *= 1 + c.BackoffJitter*(2*mathrand.Float64()-1)
+	if c.BackoffMaxSeconds > 0 && backoff > float64(c.BackoffMaxSeconds) {
+		backoff = float64(c.BackoffMaxSeconds)
+	}
+	return int(math.Round(backoff))
+}
+
+// jitterVisibility spreads visibilityTimeout by up to +/-
+// VisibilityJitterPercent, capped at maxVisibilityTimeout. With at most 50%
+// a timeout of at least 1 second stays at least 1 second.
+func (c QueueConfig) jitterVisibility(visibilityTimeout int) int {
+	if c.VisibilityJitterPercent == 0 || visibilityTimeout == 0 {
+		return visibilityTimeout
+	}
+	spread := float64(visibilityTimeout) * float64(c.VisibilityJitterPercent) / 100
+	jittered := int(math.Round(float64(visibilityTimeout) + spread*(2*mathrand.Float64()-1)))
+	return min(jittered, maxVisibilityTimeout)
+}
+
+// leaseSeconds is how long a message is hidden when it is handed out,
+// including any visibility jitter, redelivery delay and retry backoff,
+// capped at maxVisibilityTimeout.
+func (c QueueConfig) leaseSeconds(visibilityTimeout, receiveCount int) int {
+	lease := c.jitterVisibility(visibilityTimeout)
+	if receiveCount > 0 && c.RedeliveryDelaySeconds > lease {
+		lease = c.RedeliveryDelaySeconds
+	}
+	lease += c.retryBackoff(receiveCount)
+	if lease > maxVisibilityTimeout {
+		lease = maxVisibilityTimeout
+	}
+	return lease
+}
+
+func (mq *MessageQueue) addColumnIfMissing(table, column, definition string) error {
+	rows, err := mq.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	rows.Close()
+
+	_, err = mq.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s to %s: %w", column, table, err)
+	}
+	return nil
+}
+
+// cipherFor returns the cipher of the keyring key keyID, or of the default
+// encryption key if keyID is empty. The cipher is nil if there is no default
+// key.
+func (mq *MessageQueue) cipherFor(keyID string) (cipher.AEAD, error) {
+	if keyID == "" {
+		return mq.gcm, nil
+	}
+	gcm, ok := mq.keyring[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s is not in the keyring", keyID)
+	}
+	return gcm, nil
+}
+
+// sealMessage encrypts message with a fresh nonce, using the keyring key
+// keyID or else the default key. Without a key the message is returned
+// unchanged with a nil nonce.
+func (mq *MessageQueue) sealMessage(message []byte, keyID string) ([]byte, []byte, bool, error) {
+	gcm, err := mq.cipherFor(keyID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if gcm == nil {
+		return message, nil, false, nil
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, false, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nil, nonce, message, nil), nonce, true, nil
+}
+
+// openMessage reverses sealMessage, using the key the row was sealed with.
+// Plaintext rows pass through untouched so databases holding a mix of
+// encrypted and unencrypted messages keep working.
+func (mq *MessageQueue) openMessage(message, nonce []byte, encrypted bool, keyID sql.NullString) ([]byte, error) {
+	if !encrypted {
+		return message, nil
+	}
+	gcm, err := mq.cipherFor(keyID.String)
+	if err != nil {
+		return nil, err
+	}
+	if gcm == nil {
+		return nil, fmt.Errorf("message is encrypted but no encryption key is configured")
+	}
+	plaintext, err := gcm.Open(nil, nonce, message, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %w", err)
+	}
+	return plaintext, nil
+}
+
+// messageSizeLimit returns the largest message Enqueue accepts: maxBlobSize
+// when large bodies go to the blob directory, otherwise maxMessageSize.
+func (mq *MessageQueue) messageSizeLimit() int {
+	if mq.blobDir != "" {
+		return mq.maxBlobSize
+	}
+	return mq.maxMessageSize
+}
+
+// storeBlob writes a sealed message body to a new file in the blob directory
+// and returns the file's name, which the message row keeps as its blob_ref.
+// The file is written under a temporary name first, so a crash never leaves
+// a truncated body behind a reference.
+func (mq *MessageQueue) storeBlob(body []byte) (string, error) {
+	f, err := os.CreateTemp(mq.blobDir, ".blob-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob file: %w", err)
+	}
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write blob file: %w", err)
+	}
+	ref := uuid.New().String()
+	if err := os.Rename(f.Name(), filepath.Join(mq.blobDir, ref)); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to store blob file: %w", err)
+	}
+	return ref, nil
+}
+
+// loadMessage returns the plaintext of a message row, reading the body from
+// the blob directory when the row only holds a reference to it.
+func (mq *MessageQueue) loadMessage(message, nonce []byte, encrypted bool, blobRef, keyID sql.NullString) ([]byte, error) {
+	if blobRef.Valid {
+		if mq.blobDir == "" {
+			return nil, fmt.Errorf("message body is stored in blob %s but no blob directory is configured", blobRef.String)
+		}
+		body, err := os.ReadFile(filepath.Join(mq.blobDir, blobRef.String))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blob file: %w", err)
+		}
+		message = body
+	}
+	return mq.openMessage(message, nonce, encrypted, keyID)
+}
+
+// removeOrphanedBlobs deletes the files of the blob directory that no
+// message refers to any more, because the message was deleted, purged,
+// evicted or dropped, or because its enqueue failed after writing the file.
+// Must be called with the lock held, so no enqueue is between writing a file
+// and committing its reference.
+func (mq *MessageQueue) removeOrphanedBlobs() {
+	if mq.blobDir == "" {
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, table := range mq.messageTables() {
+		rows, err := mq.db.Query("SELECT blob_ref FROM " + table + " WHERE blob_ref IS NOT NULL")
+		if err != nil {
+			log.Printf("Failed to list blob references: %v", err)
+			return
+		}
+		for rows.Next() {
+			var ref string
+			if err := rows.Scan(&ref); err != nil {
+				rows.Close()
+				log.Printf("Failed to scan blob reference: %v", err)
+				return
+			}
+			referenced[ref] = true
+		}
+		rows.Close()
+	}
+
+	entries, err := os.ReadDir(mq.blobDir)
+	if err != nil {
+		log.Printf("Failed to list blob directory: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || referenced[entry.Name()] || !isBlobFileName(entry.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(mq.blobDir, entry.Name())); err != nil {
+			log.Printf("Failed to remove orphaned blob: %v", err)
+		}
+	}
+}
+
+// isBlobFileName reports whether name is one the server itself writes into
+// the blob directory: a blob named by its UUID, or a temporary file storeBlob
+// left behind. The orphan sweep leaves every other file alone.
+func isBlobFileName(name string) bool {
+	if strings.HasPrefix(name, ".blob-") {
+		return true
+	}
+	id, err := uuid.Parse(name)
+	return err == nil && id.String() == name
+}
+
+// deleteTokenClaims is the content of a signed delete token.
+type deleteTokenClaims struct {
+	MessageID int    `json:"id"`
+	QueueName string `json:"q"`
+	ExpiresAt int64  `json:"exp"` // Unix time the lease ends
+	Nonce     string `json:"n"`   // Tells apart the tokens of successive leases
+}
+
+// newTokenID returns a new unique id in the configured token format.
+func (mq *MessageQueue) newTokenID() string {
+	switch mq.tokenFormat {
+	case TokenUUIDv7:
+		return uuid.Must(uuid.NewV7()).String()
+	case TokenULID:
+		return newULID()
+	default:
+		return uuid.New().String()
+	}
+}
+
+// crockfordBase32 is the alphabet of ULIDs.
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bits of Unix time in milliseconds followed by 80
+// random bits, in Crockford's base32.
+func newULID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(fmt.Errorf("failed to generate ULID: %w", err))
+	}
+
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var encoded [26]byte
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockfordBase32[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(encoded[:])
+}
+
+// newDeleteToken returns the delete token for a lease of message id in
+// queueName ending at expiresAt. With a token secret it is a base64 blob of
+// the lease details and their HMAC-SHA256, so deletes can reject forged and
+// expired tokens and go straight to the message; otherwise a new token id.
+func (mq *MessageQueue) newDeleteToken(queueName string, id int, expiresAt int64) string {
+	nonce := mq.newTokenID()
+	if mq.tokenSecret == nil {
+		return nonce
+	}
+
+	payload, _ := json.Marshal(deleteTokenClaims{MessageID: id, QueueName: queueName, ExpiresAt: expiresAt, Nonce: nonce})
+	mac := hmac.New(sha256.New, mq.tokenSecret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseDeleteToken verifies a signed delete token and returns its claims.
+// It returns nil claims for plain UUID tokens, which have to be looked up.
+func (mq *MessageQueue) parseDeleteToken(token string) (*deleteTokenClaims, error) {
+	encodedPayload, encodedSignature, signed := strings.Cut(token, ".")
+	if !signed {
+		return nil, nil
+	}
+	if mq.tokenSecret == nil {
+		return nil, ErrInvalidDeleteToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidDeleteToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrInvalidDeleteToken
+	}
+	mac := hmac.New(sha256.New, mq.tokenSecret)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidDeleteToken
+	}
+
+	var claims deleteTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidDeleteToken
+	}
+	if claims.ExpiresAt < time.Now().Unix() {
+		return nil, ErrDeleteTokenExpired
+	}
+	return &claims, nil
+}
+
+func (mq *MessageQueue) startCleanupTask() {
+	defer mq.tasks.Done()
+
+	delay := mq.cleanupInterval
+	for {
+		if !mq.sleep(delay) {
+			return
+		}
+		if mq.cleanupOldMessages() {
+			delay = mq.cleanupInterval
+		} else {
+			delay = cleanupRetryInterval
+		}
+	}
+}
+
+// sleep pauses a background task for d and reports false, right away, if
+// the queue was closed meanwhile.
+func (mq *MessageQueue) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-mq.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Close stops the background tasks, waiting for those that are running to
+// finish, writes the stats counters and closes the database. The queue can't
+// be used afterwards.
+func (mq *MessageQueue) Close() error {
+	close(mq.done)
+	mq.tasks.Wait()
+
+	if err := mq.FlushStats(); err != nil {
+		return err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	if mq.readDB != nil {
+		if err := mq.readDB.Close(); err != nil {
+			return fmt.Errorf("failed to close read-only database: %w", err)
+		}
+	}
+	if err := mq.db.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+	return nil
+}
+
+// tryLockFor tries to take the lock for up to timeout and reports whether it
+// got it.
+func (mq *MessageQueue) tryLockFor(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !mq.lock.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(cleanupLockRetryDelay)
+	}
+	return true
+}
+
+// poisonMessageCounts returns how many messages of each queue in table have
+// exceeded maxReceives and are about to be dropped by cleanup.
+func poisonMessageCounts(db *sql.DB, table string, maxReceives int) (map[string]int, error) {
+	rows, err := db.Query("SELECT queue_name, COUNT(*) FROM "+table+" WHERE receive_count > ? AND processed = 0 GROUP BY queue_name", maxReceives)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query poison messages: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var queueName string
+		var count int
+		if err := rows.Scan(&queueName, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan poison message count: %w", err)
+		}
+		counts[queueName] = count
+	}
+	return counts, rows.Err()
+}
+
+// cleanupOldMessages runs one cleanup pass. It reports false without doing
+// anything if the lock stayed busy for cleanupLockTimeout, so that cleanup
+// backs off during traffic spikes instead of stalling queue operations.
+func (mq *MessageQueue) cleanupOldMessages() bool {
+	if !mq.tryLockFor(mq.cleanupLockTimeout) {
+		statsLock.Lock()
+		stats.CleanupSkippedCount++
+		statsLock.Unlock()
+		log.Printf("Skipping cleanup, the queue lock was busy for %v; retrying in %v", mq.cleanupLockTimeout, cleanupRetryInterval)
+		return false
+	}
+	defer mq.lock.Unlock()
+
+	start := time.Now()
+	rowsDeleted := 0
+	defer func() {
+		duration := time.Since(start)
+		statsLock.Lock()
+		stats.LastCleanupAt = start
+		stats.LastCleanupRowsDeleted = rowsDeleted
+		stats.LastCleanupDurationMs = duration.Milliseconds()
+		statsLock.Unlock()
+		if duration > cleanupWarnThreshold {
+			log.Printf("Cleanup took %v and deleted %d messages, blocking queue operations meanwhile", duration, rowsDeleted)
+		}
+	}()
+
+	hibernating := mq.updateHibernation(start)
+	skippedTables := make(map[string]bool)
+	if mq.tablePerQueue {
+		for queueName := range hibernating {
+			table, _ := mq.messageTable(queueName)
+			skippedTables[table] = true
+		}
+	}
+
+	deleteStmt := `
+		DELETE FROM %s
+		WHERE receive_count > ? AND processed = 0
+	`
+	for _, table := range mq.messageTables() {
+		if skippedTables[table] {
+			continue
+		}
+		poisonCounts, err := poisonMessageCounts(mq.db, table, mq.maxReceives)
+		if err != nil {
+			log.Printf("Failed to count poison messages: %v", err)
+		}
+		stmt, args := fmt.Sprintf(deleteStmt, table), []interface{}{mq.maxReceives}
+		if mq.poisonAction == PoisonDeadLetter {
+			// Queues with a dead letter queue are left out of the delete,
+			// so that their poison messages are kept if moving them fails
+			var kept []string
+			for queueName := range poisonCounts {
+				if mq.deadLetterPoisonMessages(table, queueName) {
+					kept = append(kept, queueName)
+					delete(poisonCounts, queueName)
+				}
+			}
+			if len(kept) > 0 {
+				stmt += " AND queue_name NOT IN (?" + strings.Repeat(", ?", len(kept)-1) + ")"
+				for _, queueName := range kept {
+					args = append(args, queueName)
+				}
+			}
+		}
+		result, err := mq.db.Exec(stmt, args...)
+		if err != nil {
+			log.Printf("Failed to cleanup old messages: %v", err)
+		} else if n, err := result.RowsAffected(); err == nil {
+			rowsDeleted += int(n)
+			for queueName, count := range poisonCounts {
+				mq.lengths.forget(queueName)
+				if err := addQueueCounter(mq.db, queueName, "poison_drop_count", count); err != nil {
+					log.Printf("Failed to count dropped poison messages: %v", err)
+				}
+			}
+		}
+		rowsDeleted += mq.purgeProcessedMessages(table, hibernating)
+	}
+
+	rows, err := mq.db.Query("SELECT DISTINCT queue_name FROM group_deliveries")
+	if err != nil {
+		log.Printf("Failed to list consumer group queues: %v", err)
+		return true
+	}
+	var groupQueues []string
+	for rows.Next() {
+		var queueName string
+		if err := rows.Scan(&queueName); err != nil {
+			log.Printf("Failed to scan consumer group queue: %v", err)
+			rows.Close()
+			return true
+		}
+		groupQueues = append(groupQueues, queueName)
+	}
+	rows.Close()
+
+	// Messages of queues with consumer groups are kept until every group
+	// registered on the queue has acknowledged them
+	groupDeleteStmt := `
+		DELETE FROM %s
+		WHERE queue_name = ? AND id IN (
+			SELECT d.message_id FROM group_deliveries d
+			WHERE d.queue_name = ? AND d.acked = 1
+			GROUP BY d.message_id
+			HAVING COUNT(*) >= (SELECT COUNT(*) FROM consumer_groups g WHERE g.queue_name = ?)
+		)
+	`
+	for _, queueName := range groupQueues {
+		if hibernating[queueName] {
+			continue
+		}
+		table, ok := mq.messageTable(queueName)
+		if ok {
+			result, err := mq.db.Exec(fmt.Sprintf(groupDeleteStmt, table), queueName, queueName, queueName)
+			if err != nil {
+				log.Printf("Failed to cleanup consumed group messages: %v", err)
+			} else if n, err := result.RowsAffected(); err == nil && n > 0 {
+				rowsDeleted += int(n)
+				mq.lengths.forget(queueName)
+			}
+			_, err = mq.db.Exec(fmt.Sprintf("DELETE FROM group_deliveries WHERE queue_name = ? AND message_id NOT IN (SELECT id FROM %s)", table), queueName)
+		} else {
+			_, err = mq.db.Exec("DELETE FROM group_deliveries WHERE queue_name = ?", queueName)
+		}
+		if err != nil {
+			log.Printf("Failed to cleanup group deliveries: %v", err)
+		}
+	}
+
+	mq.removeOrphanedBlobs()
+	return true
+}
+
+// updateHibernation returns the queues whose counters cleanup has seen
+// unchanged for hibernateAfter, and records them for /stats. A queue without
+// enqueues, dequeues or deletes can't have gained poison, processed or
+// acknowledged messages since cleanup last went through it, so skipping it
+// loses nothing but the purge of retained messages, which resumes once the
+// queue is used again. Must be called with the lock held.
+func (mq *MessageQueue) updateHibernation(now time.Time) map[string]bool {
+	if mq.hibernateAfter == 0 {
+		return nil
+	}
+
+	all, err := allQueueCounters(mq.db)
+	if err != nil {
+		// Without the counters every queue counts as active
+		log.Printf("Failed to check for hibernating queues: %v", err)
+		return nil
+	}
+
+	activity := make(map[string]queueActivity, len(all))
+	hibernating := make(map[string]bool)
+	for _, counters := range all {
+		seen, ok := mq.activity[counters.QueueName]
+		if !ok || seen.counters != counters {
+			seen = queueActivity{counters: counters, changedAt: now}
+		} else if now.Sub(seen.changedAt) >= mq.hibernateAfter {
+			hibernating[counters.QueueName] = true
+		}
+		activity[counters.QueueName] = seen
+	}
+	mq.activity = activity
+
+	mq.hibernationLock.Lock()
+	mq.hibernating = hibernating
+	mq.hibernationLock.Unlock()
+	return hibernating
+}
+
+// GetHibernatingQueues returns the queues the last cleanup run skipped for
+// being idle, sorted by name.
+func (mq *MessageQueue) GetHibernatingQueues() []string {
+	mq.hibernationLock.Lock()
+	defer mq.hibernationLock.Unlock()
+
+	queueNames := make([]string, 0, len(mq.hibernating))
+	for queueName := range mq.hibernating {
+		queueNames = append(queueNames, queueName)
+	}
+	sort.Strings(queueNames)
+	return queueNames
+}
+
+// deadLetterPoisonMessages moves the poison messages of queueName in table
+// to the queue's dead letter queue in a single transaction. It reports
+// whether the queue has a dead letter queue, in which case cleanup must not
+// drop its poison messages even if moving them failed. Must be called with
+// the lock held.
+func (mq *MessageQueue) deadLetterPoisonMessages(table, queueName string) bool {
+	config, err := mq.GetQueueConfig(queueName)
+	if err != nil {
+		log.Printf("Failed to dead-letter poison messages of queue %s: %v", queueName, err)
+		return true
+	}
+	deadLetterQueue := mq.poisonDeadLetterQueue(config)
+	if deadLetterQueue == "" {
+		return false
+	}
+
+	if err := mq.ensureMessageTable(deadLetterQueue); err != nil {
+		log.Printf("Failed to dead-letter poison messages of queue %s: %v", queueName, err)
+		return true
+	}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		log.Printf("Failed to dead-letter poison messages of queue %s: failed to begin transaction: %v", queueName, err)
+		return true
+	}
+	ids, err := mq.deadLetterMessages(tx, table, deadLetterQueue, "queue_name = ? AND receive_count > ? AND processed = 0", queueName, mq.maxReceives)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to dead-letter poison messages of queue %s: %v", queueName, err)
+		return true
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to dead-letter poison messages of queue %s: failed to commit transaction: %v", queueName, err)
+		return true
+	}
+
+	if len(ids) > 0 {
+		mq.lengths.forget(queueName)
+		mq.lengths.forget(deadLetterQueue)
+		mq.enqueueSeq++
+		mq.cond.Broadcast()
+		mq.events.publish(EventDeadLettered, queueName, ids...)
+		log.Printf("Moved %d poison messages of queue %s to dead letter queue %s", len(ids), queueName, deadLetterQueue)
+	}
+	return true
+}
+
+// poisonDeadLetterQueue returns the queue poison messages of a queue with
+// config are moved to, or "" if they are dropped.
+func (mq *MessageQueue) poisonDeadLetterQueue(config QueueConfig) string {
+	if mq.poisonAction != PoisonDeadLetter {
+		return ""
+	}
+	return config.DeadLetterQueue
+}
+
+// purgeProcessedMessages deletes the retained processed messages in table
+// that are past their queue's retention, except those of the hibernating
+// queues, and returns how many it deleted.
+func (mq *MessageQueue) purgeProcessedMessages(table string, hibernating map[string]bool) int {
+	rows, err := mq.db.Query("SELECT DISTINCT queue_name FROM " + table + " WHERE processed = 1")
+	if err != nil {
+		log.Printf("Failed to list queues with processed messages: %v", err)
+		return 0
+	}
+	var queueNames []string
+	for rows.Next() {
+		var queueName string
+		if err := rows.Scan(&queueName); err != nil {
+			log.Printf("Failed to scan queue with processed messages: %v", err)
+			rows.Close()
+			return 0
+		}
+		queueNames = append(queueNames, queueName)
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, queueName := range queueNames {
+		if hibernating[queueName] {
+			continue
+		}
+		config, err := mq.GetQueueConfig(queueName)
+		if err != nil {
+			log.Printf("Failed to purge processed messages: %v", err)
+			continue
+		}
+		cutoff := time.Now().Add(-config.retention()).UnixNano()
+		result, err := mq.db.Exec("DELETE FROM "+table+" WHERE queue_name = ? AND processed = 1 AND processed_at < ?", queueName, cutoff)
+		if err != nil {
+			log.Printf("Failed to purge processed messages: %v", err)
+		} else if n, err := result.RowsAffected(); err == nil {
+			deleted += int(n)
+		}
+	}
+	return deleted
+}
+
+// Enqueue stores message in queueName. If receiptURL is not empty, a Receipt
+// is posted to it once the message has been deleted. If dedupID is not
+// empty, the message is only stored when no pending or in-flight message of
+// the queue has the same dedup id. A message with delaySeconds above 0
+// can't be dequeued until that many seconds have passed. With withPosition
+// the result also holds the message's position, which costs counting the
+// messages ahead of it, so callers only ask when they need it.
+func (mq *MessageQueue) Enqueue(queueName string, message []byte, priority int, receiptURL, dedupID string, delaySeconds int, withPosition bool) (EnqueueResult, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	if err := mq.ensureMessageTable(queueName); err != nil {
+		return EnqueueResult{}, err
+	}
+	if err := mq.makeRoom(int64(len(message))); err != nil {
+		return EnqueueResult{}, err
+	}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return EnqueueResult{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	result, err := mq.enqueueTx(tx, queueName, message, priority, receiptURL, dedupID, delaySeconds)
+	if err != nil {
+		tx.Rollback()
+		return EnqueueResult{}, err
+	}
+
+	if withPosition {
+		table, _ := mq.messageTable(queueName)
+		position, err := messagePosition(tx, table, queueName, result.MessageID)
+		if err == nil {
+			result.Position = &position
+		} else if err != ErrMessageInFlight {
+			tx.Rollback()
+			return EnqueueResult{}, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return EnqueueResult{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if !result.Collapsed {
+		mq.enqueueSeq++
+		mq.cond.Broadcast() // Signal waiting dequeue requests
+		mq.events.publish(EventEnqueued, queueName, result.MessageID)
+		mq.countEnqueued(queueName, delaySeconds)
+	}
+	return result, nil
+}
+
+// EnqueueFanout stores a copy of message in each of queueNames within one
+// transaction. Each queue's limits and settings apply as for Enqueue; a
+// queue that rejects the message gets an error in its result without
+// affecting the others.
+func (mq *MessageQueue) EnqueueFanout(queueNames []string, message []byte, priority int) ([]FanoutResult, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	// Tables have to exist before the transaction takes its write lock
+	for _, queueName := range queueNames {
+		if err := mq.ensureMessageTable(queueName); err != nil {
+			return nil, err
+		}
+	}
+	if err := mq.makeRoom(int64(len(message) * len(queueNames))); err != nil {
+		return nil, err
+	}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	results := make([]FanoutResult, 0, len(queueNames))
+	stored := false
+	for _, queueName := range queueNames {
+		// A savepoint per target lets a rejected target be undone on its own
+		if _, err := tx.Exec("SAVEPOINT fanout_target"); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+
+		fanoutResult := FanoutResult{QueueName: queueName}
+		result, err := mq.enqueueTx(tx, queueName, message, priority, "", "", 0)
+		if err != nil {
+			if _, err := tx.Exec("ROLLBACK TO fanout_target"); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("failed to roll back to savepoint: %w", err)
+			}
+			fanoutResult.Error = err.Error()
+		} else {
+			fanoutResult.EnqueueResult = &result
+			stored = stored || !result.Collapsed
+		}
+
+		if _, err := tx.Exec("RELEASE fanout_target"); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+		results = append(results, fanoutResult)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if stored {
+		mq.enqueueSeq++
+		mq.cond.Broadcast()
+	}
+	for _, result := range results {
+		if result.EnqueueResult != nil && !result.Collapsed {
+			mq.events.publish(EventEnqueued, result.QueueName, result.MessageID)
+			mq.countEnqueued(result.QueueName, 0)
+		}
+	}
+	return results, nil
+}
+
+// EnqueueBatch stores items in queueName within one transaction, so either
+// all of them are enqueued or none are. Each message is handled as by
+// Enqueue. A batch that would push the queue over maxQueueLength is rejected
+// as a whole with a *QueueFullError. Waiting dequeues are woken once, after
+// the batch is committed.
+func (mq *MessageQueue) EnqueueBatch(queueName string, items []EnqueueItem) ([]EnqueueResult, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	if err := mq.ensureMessageTable(queueName); err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, item := range items {
+		size += len(item.Message)
+	}
+	if err := mq.makeRoom(int64(size)); err != nil {
+		return nil, err
+	}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	config, err := mq.queueConfig(tx, queueName)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if config.RingCapacity == 0 {
+		count, err := mq.getQueueLength(tx, queueName, false)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to get queue length: %w", err)
+		}
+		maxLength := config.maxLength(mq.maxQueueLength)
+		if count+len(items) > maxLength {
+			tx.Rollback()
+			return nil, &QueueFullError{QueueName: queueName, Available: max(maxLength-count, 0)}
+		}
+	}
+
+	results := make([]EnqueueResult, 0, len(items))
+	for i, item := range items {
+		result, err := mq.enqueueTx(tx, queueName, item.Message, int(item.Priority), "", "", item.DelaySeconds)
+		if err != nil {
+			tx.Rollback()
+			if err == ErrLoadShed {
+				return nil, err
+			}
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		results = append(results, result)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	var ids []int64
+	for _, result := range results {
+		if !result.Collapsed {
+			ids = append(ids, result.MessageID)
+		}
+	}
+	if len(ids) > 0 {
+		mq.enqueueSeq++
+		mq.cond.Broadcast()
+		mq.events.publish(EventEnqueued, queueName, ids...)
+		// The items' own checks may have counted the batch's uncommitted
+		// messages, so count afresh rather than adjust
+		mq.lengths.forget(queueName)
+	}
+	return results, nil
+}
+
+// countEnqueued adds a committed enqueue to the cached length of queueName.
+// Delayed messages aren't visible yet, and enqueues into a ring queue may
+// have evicted messages, so those make the queue be counted afresh.
+func (mq *MessageQueue) countEnqueued(queueName string, delaySeconds int) {
+	if mq.lengths == nil {
+		return
+	}
+	config, err := mq.queueConfig(mq.db, queueName)
+	if err != nil || delaySeconds > 0 || config.RingCapacity > 0 {
+		mq.lengths.forget(queueName)
+		return
+	}
+	mq.lengths.add(queueName, 1)
+}
+
+// ensureMessageTable creates the table of queueName if it doesn't exist yet.
+// Must be called with the lock held and outside of any transaction.
+func (mq *MessageQueue) ensureMessageTable(queueName string) error {
+	table, ok := mq.messageTable(queueName)
+	if ok {
+		return nil
+	}
+	if err := mq.createMessageTable(table); err != nil {
+		return err
+	}
+	mq.tablesLock.Lock()
+	mq.tables[table] = true
+	mq.tablesLock.Unlock()
+	return nil
+}
+
+// enqueueTx stores message in queueName within tx, applying the queue's
+// limits and settings. The queue's table must already exist. Must be called
+// with the lock held.
+func (mq *MessageQueue) enqueueTx(tx *sql.Tx, queueName string, message []byte, priority int, receiptURL, dedupID string, delaySeconds int) (EnqueueResult, error) {
+	config, err := mq.queueConfig(tx, queueName)
+	if err != nil {
+		return EnqueueResult{}, err
+	}
+
+	table, _ := mq.messageTable(queueName)
+
+	// A message with the same dedup id that hasn't been deleted yet, in
+	// flight or not, stands in for this one
+	var dedup interface{}
+	if dedupID != "" {
+		dedup = dedupID
+		var id int64
+		selectStmt := "SELECT id FROM " + table + " WHERE queue_name = ? AND dedup_id = ? AND processed = 0 LIMIT 1"
+		err := tx.QueryRow(selectStmt, queueName, dedupID).Scan(&id)
+		if err == nil {
+			return EnqueueResult{MessageID: id, Collapsed: true}, nil
+		}
+		if err != sql.ErrNoRows {
+			return EnqueueResult{}, fmt.Errorf("failed to look up message by dedup id: %w", err)
+		}
+	}
+
+	// Collapsed enqueues return the pending duplicate instead of adding one
+	var bodyHash interface{}
+	if config.CollapseDuplicates {
+		sum := sha256.Sum256(message)
+		hash := hex.EncodeToString(sum[:])
+		bodyHash = hash
+		var id int64
+		selectStmt := "SELECT id FROM " + table + " WHERE queue_name = ? AND body_hash = ? AND processed = 0 AND visibility_timestamp <= ? LIMIT 1"
+		err := tx.QueryRow(selectStmt, queueName, hash, time.Now().Unix()).Scan(&id)
+		if err == nil {
+			return EnqueueResult{MessageID: id, Collapsed: true}, nil
+		}
+		if err != sql.ErrNoRows {
+			return EnqueueResult{}, fmt.Errorf("failed to look up duplicate message: %w", err)
+		}
+	}
+
+	// Past the high-water mark only sufficiently important work gets in
+	if config.ShedHighWaterMark > 0 && priority < config.ShedBelowPriority {
+		count, err := mq.getQueueLength(tx, queueName, false)
+		if err != nil {
+			return EnqueueResult{}, fmt.Errorf("failed to get queue length: %w", err)
+		}
+		if count >= config.ShedHighWaterMark {
+			return EnqueueResult{}, ErrLoadShed
+		}
+	}
+
+	// Ring buffer queues make room by evicting instead of filling up
+	if config.RingCapacity == 0 {
+		// Check current queue length
+		count, err := mq.getQueueLength(tx, queueName, false)
+		if err != nil {
+			return EnqueueResult{}, fmt.Errorf("failed to get queue length: %w", err)
+		}
+
+		if count >= config.maxLength(mq.maxQueueLength) {
+			return EnqueueResult{}, fmt.Errorf("queue %s is full", queueName)
+		}
+	}
+
+	if len(message) > mq.messageSizeLimit() {
+		return EnqueueResult{}, fmt.Errorf("message size exceeds maximum limit of %d bytes", mq.messageSizeLimit())
+	}
+
+	body, nonce, encrypted, err := mq.sealMessage(message, config.EncryptionKeyID)
+	if err != nil {
+		return EnqueueResult{}, err
+	}
+	var keyID interface{}
+	if encrypted && config.EncryptionKeyID != "" {
+		keyID = config.EncryptionKeyID
+	}
+
+	// Bodies over the in-database limit are kept out of the database, which
+	// only stores a reference to them
+	var blobRef interface{}
+	if len(message) > mq.maxMessageSize {
+		ref, err := mq.storeBlob(body)
+		if err != nil {
+			return EnqueueResult{}, err
+		}
+		blobRef = ref
+		body = []byte{}
+	}
+
+	if config.RingCapacity > 0 {
+		if err := evictOldestMessages(tx, table, queueName, config.RingCapacity-1); err != nil {
+			return EnqueueResult{}, err
+		}
+	}
+
+	createdAt := time.Now().UnixNano()
+	// Delayed messages start out hidden, like a message in flight that was
+	// never received
+	var visibilityTimestamp int64
+	if delaySeconds > 0 {
+		visibilityTimestamp = time.Now().Unix() + int64(delaySeconds)
+	}
+	var receipt interface{}
+	if receiptURL != "" {
+		receipt = receiptURL
+	}
+	var sortKey interface{}
+	if config.SortKeyField != "" {
+		if key, ok := extractSortKey(message, config.SortKeyField); ok {
+			sortKey = key
+		}
+	}
+	result, err := tx.Exec("INSERT INTO "+table+" (queue_name, message, priority, created_at, encrypted, nonce, body_hash, receipt_url, blob_ref, dedup_id, sort_key, key_id, visibility_timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", queueName, body, priority, createdAt, encrypted, nonce, bodyHash, receipt, blobRef, dedup, sortKey, keyID, visibilityTimestamp)
+	if err != nil {
+		return EnqueueResult{}, fmt.Errorf("failed to execute enqueue statement: %w", err)
+	}
+
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return EnqueueResult{}, fmt.Errorf("failed to retrieve message id: %w", err)
+	}
+
+	if err := addQueueCounter(tx, queueName, "enqueue_count", 1); err != nil {
+		return EnqueueResult{}, err
+	}
+	return EnqueueResult{MessageID: messageID}, nil
+}
+
+// extractSortKey returns the numeric top-level field of a JSON object
+// message. It reports false if the message isn't a JSON object or the field
+// is missing or not a number.
+func extractSortKey(message []byte, field string) (float64, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return 0, false
+	}
+	raw, ok := fields[field]
+	if !ok {
+		return 0, false
+	}
+	var key float64
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return 0, false
+	}
+	return key, true
+}
+
+// evictOldestMessages deletes the oldest messages of queueName, in flight or
+// not, until at most keep remain.
+func evictOldestMessages(tx *sql.Tx, table, queueName string, keep int) error {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE queue_name = ? AND processed = 0", queueName).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to count messages: %w", err)
+	}
+	if count <= keep {
+		return nil
+	}
+
+	evictStmt := `
+		DELETE FROM %[1]s WHERE id IN (
+			SELECT id FROM %[1]s
+			WHERE queue_name = ? AND processed = 0
+			ORDER BY created_at ASC, id ASC LIMIT ?
+		)
+	`
+	_, err = tx.Exec(fmt.Sprintf(evictStmt, table), queueName, count-keep)
+	if err != nil {
+		return fmt.Errorf("failed to evict oldest messages: %w", err)
+	}
+	return nil
+}
+
+// databaseSize returns how many bytes the pages of the database in use take
+// up. Pages freed by deletes stay in the file, but they are reused before it
+// grows, so they don't count. The write-ahead log and blob files aren't
+// counted either: evicting grows the log until the next checkpoint, so
+// counting it would make eviction chase its own tail.
+func databaseSize(q querier) (int64, error) {
+	var pageCount, freePages, pageSize int64
+	if err := q.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return 0, fmt.Errorf("failed to read page count: %w", err)
+	}
+	if err := q.QueryRow("PRAGMA freelist_count").Scan(&freePages); err != nil {
+		return 0, fmt.Errorf("failed to read free page count: %w", err)
+	}
+	if err := q.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("failed to read page size: %w", err)
+	}
+	return (pageCount - freePages) * pageSize, nil
+}
+
+// makeRoom makes sure that incoming more bytes fit under maxDBBytes,
+// evicting messages if they don't, and returns ErrDatabaseFull if that isn't
+// enough. Must be called with the lock held, before the enqueue's
+// transaction begins.
+func (mq *MessageQueue) makeRoom(incoming int64) error {
+	if mq.maxDBBytes == 0 {
+		return nil
+	}
+	if incoming >= mq.maxDBBytes {
+		return ErrDatabaseFull
+	}
+	ok, err := mq.evictForSpace(mq.maxDBBytes - incoming)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDatabaseFull
+	}
+	return nil
+}
+
+// startEvictionTask keeps the database dbEvictionHeadroom percent below
+// maxDBBytes, so that enqueues rarely have to wait for an eviction.
+func (mq *MessageQueue) startEvictionTask() {
+	defer mq.tasks.Done()
+
+	target := mq.maxDBBytes * (100 - dbEvictionHeadroom) / 100
+	for mq.sleep(dbSizeCheckInterval) {
+		mq.lock.Lock()
+		_, err := mq.evictForSpace(target)
+		mq.lock.Unlock()
+		if err != nil {
+			log.Printf("Failed to evict messages: %v", err)
+		}
+	}
+}
+
+// evictionCandidate is a message evictForSpace may delete.
+type evictionCandidate struct {
+	table     string
+	queueName string
+	id        int64
+	processed bool
+	priority  int
+	createdAt int64
+}
+
+// evictForSpace deletes messages, dbEvictionBatch at a time, until the
+// database takes up less than target bytes, and reports false if it runs out
+// of messages to delete first. Retained processed messages go first, then
+// visible messages from the lowest priority and oldest up; in-flight and
+// delayed messages are never evicted. Must be called with the lock held.
+func (mq *MessageQueue) evictForSpace(target int64) (bool, error) {
+	evicted := make(map[string]int)
+	defer func() {
+		total := 0
+		for queueName, count := range evicted {
+			log.Printf("Evicted %d messages of queue %s to keep the database under %d bytes", count, queueName, mq.maxDBBytes)
+			total += count
+		}
+		if total > 0 {
+			statsLock.Lock()
+			stats.EvictedCount += total
+			statsLock.Unlock()
+			mq.lengths.forget("*")
+		}
+	}()
+
+	for {
+		size, err := databaseSize(mq.db)
+		if err != nil {
+			return false, err
+		}
+		if size < target {
+			return true, nil
+		}
+
+		candidates, err := mq.evictionCandidates()
+		if err != nil {
+			return false, err
+		}
+		if len(candidates) == 0 {
+			return false, nil
+		}
+
+		tx, err := mq.db.Begin()
+		if err != nil {
+			return false, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		for _, candidate := range candidates {
+			if _, err := tx.Exec("DELETE FROM "+candidate.table+" WHERE id = ?", candidate.id); err != nil {
+				tx.Rollback()
+				return false, fmt.Errorf("failed to evict message: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return false, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		for _, candidate := range candidates {
+			evicted[candidate.queueName]++
+		}
+	}
+}
+
+// evictionCandidates returns the next dbEvictionBatch messages to evict,
+// across all message tables, in the order evictForSpace evicts them.
+func (mq *MessageQueue) evictionCandidates() ([]evictionCandidate, error) {
+	selectStmt := `
+		SELECT id, queue_name, processed, priority, created_at FROM %s
+		WHERE processed = 1 OR visibility_timestamp <= ?
+		ORDER BY processed DESC, priority ASC, created_at ASC, id ASC LIMIT ?
+	`
+	now := time.Now().Unix()
+	var candidates []evictionCandidate
+	for _, table := range mq.messageTables() {
+		rows, err := mq.db.Query(fmt.Sprintf(selectStmt, table), now, dbEvictionBatch)
+		if isMissingTable(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to select messages to evict: %w", err)
+		}
+		for rows.Next() {
+			candidate := evictionCandidate{table: table}
+			if err := rows.Scan(&candidate.id, &candidate.queueName, &candidate.processed, &candidate.priority, &candidate.createdAt); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan message to evict: %w", err)
+			}
+			candidates = append(candidates, candidate)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to select messages to evict: %w", err)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.processed != b.processed {
+			return a.processed
+		}
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.createdAt != b.createdAt {
+			return a.createdAt < b.createdAt
+		}
+		return a.id < b.id
+	})
+	if len(candidates) > dbEvictionBatch {
+		candidates = candidates[:dbEvictionBatch]
+	}
+	return candidates, nil
+}
+
+// countFilter is the condition selecting the messages queue lengths count:
+// the visible ones, plus the retained processed ones if includeProcessed is
+// set. It takes the current time as its only parameter.
+func countFilter(includeProcessed bool) string {
+	if includeProcessed {
+		return "((processed = 0 AND visibility_timestamp <= ?) OR processed = 1)"
+	}
+	return "processed = 0 AND visibility_timestamp <= ?"
+}
+
+func (mq *MessageQueue) getQueueLength(q querier, queueName string, includeProcessed bool) (int, error) {
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, nil
+	}
+	if !includeProcessed {
+		if count, ok := mq.lengths.get(queueName); ok {
+			return count, nil
+		}
+	}
+
+	currentTime := time.Now().Unix()
+	stmt := "SELECT COUNT(*) AS count FROM " + table + " WHERE queue_name = ? AND " + countFilter(includeProcessed)
+	row := q.QueryRow(stmt, queueName, currentTime)
+
+	var count int
+	err := row.Scan(&count)
+	if isMissingTable(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan queue length: %w", err)
+	}
+	if !includeProcessed {
+		mq.lengths.set(queueName, count)
+	}
+	return count, nil
+}
+
+// Dequeue leases the next visible message of queueName, or returns nil if
+// there is none.
+func (mq *MessageQueue) Dequeue(queueName string, visibilityTimeout, databasePollInterval int, withQueueStats bool, leaseOwner, processingLabel string) (*DequeuedMessage, error) {
+	messages, err := mq.DequeueMany(queueName, visibilityTimeout, databasePollInterval, 1, withQueueStats, leaseOwner, processingLabel)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+// DequeueMany leases up to maxMessages visible messages of queueName in
+// dequeue order, each with its own delete token, within one transaction. It
+// returns fewer if the queue or --max-in-flight runs out first, and none if
+// the queue is empty.
+func (mq *MessageQueue) DequeueMany(queueName string, visibilityTimeout, databasePollInterval, maxMessages int, withQueueStats bool, leaseOwner, processingLabel string) ([]*DequeuedMessage, error) {
+	mq.lock.Lock()
+	table, ok := mq.messageTable(queueName)
+	mq.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	// Preliminary check without locking
+	currentTime := time.Now().Unix()
+	selectStmt := `
+		SELECT id, message, receive_count, encrypted, nonce, priority, created_at, blob_ref, key_id FROM %s
+		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ?
+		ORDER BY priority DESC, sort_key IS NULL, sort_key ASC, created_at ASC, id ASC LIMIT 1
+	`
+	var id int
+	var message []byte
+	var receiveCount int
+	var encrypted bool
+	var nonce []byte
+	var priority int
+	var createdAt int64
+	var blobRef, keyID sql.NullString
+	err := mq.reader().QueryRow(fmt.Sprintf(selectStmt, table), queueName, currentTime).Scan(&id, &message, &receiveCount, &encrypted, &nonce, &priority, &createdAt, &blobRef, &keyID)
+	if err != nil && err != sql.ErrNoRows && !isMissingTable(err) {
+		return nil, fmt.Errorf("failed to preliminarily select message: %w", err)
+	}
+	if err != nil {
+		// No message available, return immediately
+		return nil, nil
+	}
+
+	// Locking section for the actual dequeue operation
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	// The queue may have been deleted meanwhile
+	if _, ok := mq.messageTable(queueName); !ok {
+		return nil, nil
+	}
+
+	config, err := mq.GetQueueConfig(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	// A zero timeout would make the message visible again the moment it is
+	// handed out, so the next dequeue could deliver it a second time before
+	// this consumer has even started on it. Zero and negative values
+	// therefore fall back to the default rather than disabling the timeout.
+	visibilityTimeout = config.visibilityTimeout(visibilityTimeout, mq.visibilityTimeout)
+
+	// Poison messages are moved while the transaction is open, when the
+	// dead letter queue's table can no longer be created
+	deadLetterQueue := mq.poisonDeadLetterQueue(config)
+	if deadLetterQueue != "" {
+		if err := mq.ensureMessageTable(deadLetterQueue); err != nil {
+			return nil, err
+		}
+	}
+
+	selectStmt = fmt.Sprintf(selectStmt, table)
+	updateStmt := `
+		UPDATE ` + table + `
+		SET visibility_timestamp = ?, delete_token = ?, receive_count = receive_count + 1, lease_owner = ?, last_heartbeat_at = NULL, leased_at = ?, processing_label = ?
+		WHERE id = ?
+	`
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var messages []*DequeuedMessage
+	var deadLettered []int64
+	poisoned := false
+	skipped := false
+	for len(messages) < maxMessages {
+		err = tx.QueryRow(selectStmt, queueName, currentTime).Scan(&id, &message, &receiveCount, &encrypted, &nonce, &priority, &createdAt, &blobRef, &keyID)
+		if err == sql.ErrNoRows {
+			// Another consumer may have taken the message after the
+			// preliminary check; the queue poller will try again on the
+			// next enqueue
+			break
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to select message: %w", err)
+		}
+
+		// Check if the message has exceeded the max receive count
+		if receiveCount >= mq.maxReceives {
+			// Handle the poison message (delete or move to the dead letter queue)
+			if deadLetterQueue != "" {
+				ids, err := mq.deadLetterMessages(tx, table, deadLetterQueue, "id = ?", id)
+				if err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+				deadLettered = append(deadLettered, ids...)
+			} else {
+				deleteStmt := `DELETE FROM ` + table + ` WHERE id = ?`
+				_, err := tx.Exec(deleteStmt, id)
+				if err != nil {
+					tx.Rollback()
+					return nil, fmt.Errorf("failed to delete poison message: %w", err)
+				}
+				if err := addQueueCounter(tx, queueName, "poison_drop_count", 1); err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			}
+			poisoned = true
+			continue // Retry the loop to get the next message
+		}
+
+		plaintext, err := mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+		if err != nil {
+			// A body that can't be read must not block the messages behind
+			// it. It counts as received and is hidden for a lease, so it
+			// reaches the poison handling above after --max-receives tries.
+			log.Printf("Skipping unreadable message %d of queue %s: %v", id, queueName, err)
+			hiddenUntil := time.Now().Unix() + int64(config.leaseSeconds(visibilityTimeout, receiveCount))
+			if _, err := tx.Exec("UPDATE "+table+" SET visibility_timestamp = ?, receive_count = receive_count + 1 WHERE id = ?", hiddenUntil, id); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("failed to skip unreadable message: %w", err)
+			}
+			skipped = true
+			continue
+		}
+
+		// Messages already leased in this transaction count towards the limit
+		if err := mq.checkInFlightLimit(tx); err != nil {
+			if err == ErrInFlightLimit && len(messages) > 0 {
+				break
+			}
+			tx.Rollback()
+			return nil, err
+		}
+
+		// currentTime was taken before waiting for the lock, so measure the
+		// lease from now to avoid handing out a shorter one than requested
+		leasedAt := time.Now().Unix()
+		newVisibilityTimestamp := leasedAt + int64(config.leaseSeconds(visibilityTimeout, receiveCount))
+		deleteToken := mq.newDeleteToken(queueName, id, newVisibilityTimestamp)
+		_, err = tx.Exec(updateStmt, newVisibilityTimestamp, deleteToken, nullableString(leaseOwner), leasedAt, nullableString(processingLabel), id)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update message: %w", err)
+		}
+		if err := addQueueCounter(tx, queueName, "dequeue_count", 1); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		messages = append(messages, &DequeuedMessage{
+			MessageID:    id,
+			Message:      plaintext,
+			Priority:     priority,
+			CreatedAt:    time.Unix(0, createdAt),
+			ReceiveCount: receiveCount + 1,
+			DeleteToken:  deleteToken,
+		})
+	}
+
+	// Taken inside the transaction so it matches the dequeue exactly
+	if withQueueStats && len(messages) > 0 {
+		now := time.Now()
+		var remaining int
+		var oldestCreatedAt sql.NullInt64
+		statsStmt := "SELECT COUNT(*), MIN(created_at) FROM " + table + " WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ?"
+		err = tx.QueryRow(statsStmt, queueName, now.Unix()).Scan(&remaining, &oldestCreatedAt)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to read queue stats: %w", err)
+		}
+		var oldestAgeSeconds int64
+		if oldestCreatedAt.Valid {
+			oldestAgeSeconds = (now.UnixNano() - oldestCreatedAt.Int64) / int64(time.Second)
+		}
+		for _, dequeued := range messages {
+			dequeued.Remaining = &remaining
+			dequeued.OldestAgeSeconds = &oldestAgeSeconds
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if len(deadLettered) > 0 {
+		mq.enqueueSeq++
+		mq.events.publish(EventDeadLettered, queueName, deadLettered...)
+	}
+	if poisoned {
+		mq.cond.Broadcast()
+		mq.lengths.forget(queueName)
+		if len(deadLettered) > 0 {
+			mq.lengths.forget(mq.poisonDeadLetterQueue(config))
+		}
+	} else if skipped {
+		mq.lengths.forget(queueName)
+	} else {
+		mq.lengths.add(queueName, -len(messages))
+	}
+	for _, dequeued := range messages {
+		mq.events.publish(EventDequeued, queueName, int64(dequeued.MessageID))
+	}
+	return messages, nil
+}
+
+// nullableString maps "" to NULL for optional text columns.
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// DequeueGroup delivers the next message of queueName that consumerGroup has
+// not acknowledged yet. Every consumer group sees every message, while
+// consumers within a group compete for them as with Dequeue. Groups register
+// themselves on their first dequeue.
+func (mq *MessageQueue) DequeueGroup(queueName, consumerGroup string, visibilityTimeout int) (*DequeuedMessage, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	config, err := mq.GetQueueConfig(queueName)
+	if err != nil {
+		return nil, err
+	}
+	visibilityTimeout = config.visibilityTimeout(visibilityTimeout, mq.visibilityTimeout)
+
+	table, ok := mq.messageTable(queueName)
+
+	selectStmt := `
+		SELECT m.id, m.message, m.encrypted, m.nonce, COALESCE(d.receive_count, 0), m.priority, m.created_at, m.blob_ref, m.key_id
+		FROM ` + table + ` m
+		LEFT JOIN group_deliveries d
+			ON d.queue_name = m.queue_name AND d.group_name = ? AND d.message_id = m.id
+		WHERE m.queue_name = ? AND m.processed = 0
+			AND (d.message_id IS NULL OR (d.acked = 0 AND d.visibility_timestamp <= ?))
+		ORDER BY m.priority DESC, m.sort_key IS NULL, m.sort_key ASC, m.created_at ASC, m.id ASC LIMIT 1
+	`
+	upsertStmt := `
+		INSERT INTO group_deliveries (queue_name, group_name, message_id, visibility_timestamp, delete_token, receive_count, acked)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (queue_name, group_name, message_id) DO UPDATE SET
+			visibility_timestamp = excluded.visibility_timestamp,
+			delete_token = excluded.delete_token,
+			receive_count = excluded.receive_count,
+			acked = excluded.acked
+	`
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO consumer_groups (queue_name, group_name, created_at) VALUES (?, ?, ?)", queueName, consumerGroup, time.Now().UnixNano())
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to register consumer group: %w", err)
+	}
+
+	if !ok {
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil, nil
+	}
+
+	for {
+		var id int
+		var message, nonce []byte
+		var encrypted bool
+		var receiveCount, priority int
+		var createdAt int64
+		var blobRef, keyID sql.NullString
+		err = tx.QueryRow(selectStmt, consumerGroup, queueName, time.Now().Unix()).Scan(&id, &message, &encrypted, &nonce, &receiveCount, &priority, &createdAt, &blobRef, &keyID)
+		if err == sql.ErrNoRows {
+			// Still commit so the group's registration sticks
+			if err := tx.Commit(); err != nil {
+				return nil, fmt.Errorf("failed to commit transaction: %w", err)
+			}
+			return nil, nil
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to select message: %w", err)
+		}
+
+		// A poison message is given up on for this group only
+		if receiveCount >= mq.maxReceives {
+			_, err = tx.Exec(upsertStmt, queueName, consumerGroup, id, 0, nil, receiveCount, true)
+			if err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("failed to drop poison message for group: %w", err)
+			}
+			if err := addQueueCounter(tx, queueName, "poison_drop_count", 1); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			continue
+		}
+
+		plaintext, err := mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+		if err != nil {
+			// Skipped for this group as in DequeueMany, so the group's
+			// poison handling gives up on it after --max-receives tries
+			log.Printf("Skipping unreadable message %d of queue %s for group %s: %v", id, queueName, consumerGroup, err)
+			hiddenUntil := time.Now().Unix() + int64(config.leaseSeconds(visibilityTimeout, receiveCount))
+			if _, err := tx.Exec(upsertStmt, queueName, consumerGroup, id, hiddenUntil, nil, receiveCount+1, false); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("failed to skip unreadable message for group: %w", err)
+			}
+			continue
+		}
+
+		if err := mq.checkInFlightLimit(tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		deleteToken := mq.newTokenID()
+		newVisibilityTimestamp := time.Now().Unix() + int64(config.leaseSeconds(visibilityTimeout, receiveCount))
+		_, err = tx.Exec(upsertStmt, queueName, consumerGroup, id, newVisibilityTimestamp, deleteToken, receiveCount+1, false)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to record group delivery: %w", err)
+		}
+		if err := addQueueCounter(tx, queueName, "dequeue_count", 1); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		mq.events.publish(EventDequeued, queueName, int64(id))
+		return &DequeuedMessage{
+			MessageID:    id,
+			Message:      plaintext,
+			Priority:     priority,
+			CreatedAt:    time.Unix(0, createdAt),
+			ReceiveCount: receiveCount + 1,
+			DeleteToken:  deleteToken,
+		}, nil
+	}
+}
+
+// DequeueByID leases the message with the given id in queueName, as Dequeue
+// would have if it had been at the head of the queue. It fails with
+// ErrMessageInFlight if the message is currently leased and with
+// ErrMessageNotFound if there is no such message. Unlike Dequeue it is meant
+// for deliberate reprocessing, so it ignores retry backoff and max receives.
+func (mq *MessageQueue) DequeueByID(queueName string, id, visibilityTimeout int, leaseOwner, processingLabel string) (*DequeuedMessage, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+
+	config, err := mq.GetQueueConfig(queueName)
+	if err != nil {
+		return nil, err
+	}
+	visibilityTimeout = config.visibilityTimeout(visibilityTimeout, mq.visibilityTimeout)
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var message, nonce []byte
+	var encrypted bool
+	var visibilityTimestamp, createdAt int64
+	var priority, receiveCount int
+	var blobRef, keyID sql.NullString
+	selectStmt := "SELECT message, encrypted, nonce, visibility_timestamp, priority, created_at, receive_count, blob_ref, key_id FROM " + table + " WHERE id = ? AND queue_name = ? AND processed = 0"
+	err = tx.QueryRow(selectStmt, id, queueName).Scan(&message, &encrypted, &nonce, &visibilityTimestamp, &priority, &createdAt, &receiveCount, &blobRef, &keyID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to select message: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if visibilityTimestamp > now {
+		tx.Rollback()
+		return nil, ErrMessageInFlight
+	}
+
+	plaintext, err := mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := mq.checkInFlightLimit(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	expiresAt := now + int64(config.jitterVisibility(visibilityTimeout))
+	deleteToken := mq.newDeleteToken(queueName, id, expiresAt)
+	updateStmt := "UPDATE " + table + " SET visibility_timestamp = ?, delete_token = ?, receive_count = receive_count + 1, lease_owner = ?, last_heartbeat_at = NULL, leased_at = ?, processing_label = ? WHERE id = ?"
+	_, err = tx.Exec(updateStmt, expiresAt, deleteToken, nullableString(leaseOwner), now, nullableString(processingLabel), id)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update message: %w", err)
+	}
+	if err := addQueueCounter(tx, queueName, "dequeue_count", 1); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mq.lengths.add(queueName, -1)
+	mq.events.publish(EventDequeued, queueName, int64(id))
+	return &DequeuedMessage{
+		MessageID:    id,
+		Message:      plaintext,
+		Priority:     priority,
+		CreatedAt:    time.Unix(0, createdAt),
+		ReceiveCount: receiveCount + 1,
+		DeleteToken:  deleteToken,
+	}, nil
+}
+
+// ClaimAll leases up to limit visible messages of queueName in one
+// transaction, those enqueued at least minAgeSeconds and, unless
+// maxAgeSeconds is 0, at most maxAgeSeconds ago. Messages are claimed in
+// priority order, oldest first. Poison messages are left for dequeue and
+// cleanup to deal with. With --max-in-flight, only as many messages are
+// claimed as fit under the limit, and ErrInFlightLimit is returned if none
+// do.
+func (mq *MessageQueue) ClaimAll(queueName string, visibilityTimeout, minAgeSeconds, maxAgeSeconds, limit int, leaseOwner, processingLabel string) ([]DequeuedMessage, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	claimed := []DequeuedMessage{}
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return claimed, nil
+	}
+
+	config, err := mq.GetQueueConfig(queueName)
+	if err != nil {
+		return nil, err
+	}
+	visibilityTimeout = config.visibilityTimeout(visibilityTimeout, mq.visibilityTimeout)
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if mq.maxInFlight > 0 {
+		count, err := mq.inFlightCount(tx)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if count >= mq.maxInFlight {
+			tx.Rollback()
+			return nil, ErrInFlightLimit
+		}
+		limit = min(limit, mq.maxInFlight-count)
+	}
+
+	now := time.Now()
+	selectStmt := `
+		SELECT id, message, encrypted, nonce, priority, created_at, receive_count, blob_ref, key_id FROM ` + table + `
+		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ? AND receive_count < ? AND created_at <= ?
+	`
+	args := []interface{}{queueName, now.Unix(), mq.maxReceives, now.Add(-time.Duration(minAgeSeconds) * time.Second).UnixNano()}
+	if maxAgeSeconds > 0 {
+		selectStmt += " AND created_at >= ?"
+		args = append(args, now.Add(-time.Duration(maxAgeSeconds)*time.Second).UnixNano())
+	}
+	selectStmt += " ORDER BY priority DESC, sort_key IS NULL, sort_key ASC, created_at ASC, id ASC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := tx.Query(selectStmt, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to select messages: %w", err)
+	}
+	for rows.Next() {
+		var m DequeuedMessage
+		var message, nonce []byte
+		var encrypted bool
+		var createdAt int64
+		var blobRef, keyID sql.NullString
+		if err := rows.Scan(&m.MessageID, &message, &encrypted, &nonce, &m.Priority, &createdAt, &m.ReceiveCount, &blobRef, &keyID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		m.Message, err = mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		m.CreatedAt = time.Unix(0, createdAt)
+		m.ReceiveCount++
+		claimed = append(claimed, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to select messages: %w", err)
+	}
+
+	updateStmt := "UPDATE " + table + " SET visibility_timestamp = ?, delete_token = ?, receive_count = receive_count + 1, lease_owner = ?, last_heartbeat_at = NULL, leased_at = ?, processing_label = ? WHERE id = ?"
+	ids := make([]int64, len(claimed))
+	for i := range claimed {
+		expiresAt := now.Unix() + int64(config.jitterVisibility(visibilityTimeout))
+		claimed[i].DeleteToken = mq.newDeleteToken(queueName, claimed[i].MessageID, expiresAt)
+		_, err := tx.Exec(updateStmt, expiresAt, claimed[i].DeleteToken, nullableString(leaseOwner), now.Unix(), nullableString(processingLabel), claimed[i].MessageID)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update message: %w", err)
+		}
+		ids[i] = int64(claimed[i].MessageID)
+	}
+	if err := addQueueCounter(tx, queueName, "dequeue_count", len(claimed)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mq.lengths.add(queueName, -len(claimed))
+	if len(ids) > 0 {
+		mq.events.publish(EventDequeued, queueName, ids...)
+	}
+	return claimed, nil
+}
+
+// GetLeases returns the messages leaseOwner dequeued that are still in
+// flight, so a restarted consumer can pick up where it left off.
+func (mq *MessageQueue) GetLeases(leaseOwner string) ([]Lease, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	now := time.Now().Unix()
+	stmt := `
+		SELECT queue_name, id, message, encrypted, nonce, delete_token, visibility_timestamp, last_heartbeat_at, blob_ref, key_id
+		FROM %s
+		WHERE lease_owner = ? AND processed = 0 AND visibility_timestamp > ?
+		ORDER BY visibility_timestamp, id
+	`
+
+	result := []Lease{}
+	for _, table := range mq.messageTables() {
+		rows, err := mq.db.Query(fmt.Sprintf(stmt, table), leaseOwner, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query leases: %w", err)
+		}
+
+		for rows.Next() {
+			var lease Lease
+			var message, nonce []byte
+			var encrypted bool
+			var visibilityTimestamp int64
+			var lastHeartbeatAt sql.NullInt64
+			var blobRef, keyID sql.NullString
+			if err := rows.Scan(&lease.QueueName, &lease.MessageID, &message, &encrypted, &nonce, &lease.DeleteToken, &visibilityTimestamp, &lastHeartbeatAt, &blobRef, &keyID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan lease: %w", err)
+			}
+			lease.Message, err = mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			lease.ExpiresAt = time.Unix(visibilityTimestamp, 0)
+			if lastHeartbeatAt.Valid {
+				heartbeatAt := time.Unix(0, lastHeartbeatAt.Int64)
+				lease.LastHeartbeatAt = &heartbeatAt
+			}
+			result = append(result, lease)
+		}
+		rows.Close()
+	}
+	return result, nil
+}
+
+// RemoveConsumerGroup unregisters consumerGroup from queueName, so cleanup no
+// longer waits for it to acknowledge messages.
+func (mq *MessageQueue) RemoveConsumerGroup(queueName, consumerGroup string) (bool, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	result, err := tx.Exec("DELETE FROM consumer_groups WHERE queue_name = ? AND group_name = ?", queueName, consumerGroup)
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to remove consumer group: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM group_deliveries WHERE queue_name = ? AND group_name = ?", queueName, consumerGroup)
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to remove consumer group deliveries: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// WaitForMessage parks attempt on the poller identified by pollerKey until it
+// reports that it was served, returns an error, or ctx is done. It returns
+// false when ctx finished first. attempt is only ever called from the poller
+// goroutine, and waiters sharing a key must be served by the same query.
+func (mq *MessageQueue) WaitForMessage(ctx context.Context, pollerKey string, interval time.Duration, attempt func() (bool, error)) (bool, error) {
+	waiter := &dequeueWaiter{attempt: attempt, done: make(chan error, 1)}
+
+	mq.pollersLock.Lock()
+	poller, ok := mq.pollers[pollerKey]
+	if !ok {
+		poller = &queuePoller{interval: interval}
+		mq.pollers[pollerKey] = poller
+		go mq.runPoller(pollerKey, poller)
+	}
+	poller.lock.Lock()
+	poller.waiters = append(poller.waiters, waiter)
+	if interval < poller.interval {
+		poller.interval = interval
+	}
+	poller.lock.Unlock()
+	mq.pollersLock.Unlock()
+
+	select {
+	case err := <-waiter.done:
+		return err == nil, err
+	case <-ctx.Done():
+		if poller.removeWaiter(waiter) {
+			return false, nil
+		}
+		// The poller got to the waiter before we could withdraw it
+		err := <-waiter.done
+		return err == nil, err
+	}
+}
+
+func (mq *MessageQueue) runPoller(pollerKey string, poller *queuePoller) {
+	for {
+		mq.pollersLock.Lock()
+		poller.lock.Lock()
+		if len(poller.waiters) == 0 {
+			delete(mq.pollers, pollerKey)
+			poller.lock.Unlock()
+			mq.pollersLock.Unlock()
+			return
+		}
+		interval := poller.interval
+		poller.lock.Unlock()
+		mq.pollersLock.Unlock()
+
+		mq.lock.Lock()
+		seen := mq.enqueueSeq
+		mq.lock.Unlock()
+
+		poller.serve()
+
+		// Sleep until an enqueue happens or the poll interval passes
+		timedOut := false
+		timer := time.AfterFunc(interval, func() {
+			mq.lock.Lock()
+			timedOut = true
+			mq.lock.Unlock()
+			mq.cond.Broadcast()
+		})
+		mq.lock.Lock()
+		for mq.enqueueSeq == seen && !timedOut {
+			mq.cond.Wait()
+		}
+		mq.lock.Unlock()
+		timer.Stop()
+	}
+}
+
+// serve hands messages to waiters in arrival order until the queue runs dry.
+func (p *queuePoller) serve() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(p.waiters) > 0 {
+		waiter := p.waiters[0]
+		served, err := waiter.attempt()
+		if err == nil && !served {
+			return
+		}
+		p.waiters = p.waiters[1:]
+		waiter.done <- err
+	}
+}
+
+func (p *queuePoller) removeWaiter(waiter *dequeueWaiter) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, w := range p.waiters {
+		if w == waiter {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// findLeasedMessage looks up the message leased out under deleteToken within
+// tx, using the claims of a signed token when there are any. It returns
+// ErrMessageNotFound if there is no such message; consumer group deliveries
+// are not considered.
+func (mq *MessageQueue) findLeasedMessage(tx *sql.Tx, deleteToken string, claims *deleteTokenClaims) (table, queueName string, id int, err error) {
+	// Plain delete tokens don't name their queue, so try every table
+	tables := mq.messageTables()
+	selectStmt := "SELECT id, queue_name FROM %s WHERE delete_token = ?"
+	args := []interface{}{deleteToken}
+	if claims != nil {
+		table, ok := mq.messageTable(claims.QueueName)
+		if !ok {
+			return "", "", 0, ErrMessageNotFound
+		}
+		tables = []string{table}
+		selectStmt = "SELECT id, queue_name FROM %s WHERE id = ? AND delete_token = ?"
+		args = []interface{}{claims.MessageID, deleteToken}
+	}
+
+	for _, table := range tables {
+		err := tx.QueryRow(fmt.Sprintf(selectStmt, table), args...).Scan(&id, &queueName)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return "", "", 0, fmt.Errorf("failed to select message: %w", err)
+		}
+		return table, queueName, id, nil
+	}
+	return "", "", 0, ErrMessageNotFound
+}
+
+func (mq *MessageQueue) DeleteMessage(deleteToken string) (bool, error) {
+	claims, err := mq.parseDeleteToken(deleteToken)
+	if err != nil {
+		return false, err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var result sql.Result
+	var rowsAffected int64
+	var deletedQueue string
+	var deletedID int64
+	var receiptURL sql.NullString
+	var createdAt int64
+	table, queueName, id, err := mq.findLeasedMessage(tx, deleteToken, claims)
+	if err != nil && err != ErrMessageNotFound {
+		tx.Rollback()
+		return false, err
+	}
+	if err == nil {
+		config, err := mq.queueConfig(tx, queueName)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+
+		err = tx.QueryRow("SELECT receipt_url, created_at FROM "+table+" WHERE id = ?", id).Scan(&receiptURL, &createdAt)
+		if err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("failed to select message: %w", err)
+		}
+
+		// Queues that retain processed messages keep them for replay
+		if config.RetainProcessed {
+			_, err = tx.Exec("UPDATE "+table+" SET processed = 1, processed_at = ?, delete_token = NULL, lease_owner = NULL WHERE id = ?", time.Now().UnixNano(), id)
+		} else {
+			_, err = tx.Exec("DELETE FROM "+table+" WHERE id = ?", id)
+		}
+		if err != nil {
+			tx.Rollback()
+			return false, fmt.Errorf("failed to execute delete statement: %w", err)
+		}
+		if err := addQueueCounter(tx, queueName, "delete_count", 1); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		rowsAffected = 1
+		deletedQueue, deletedID = queueName, int64(id)
+		mq.cond.Broadcast() // Wake /wait_empty requests waiting for the queue to drain
+	}
+
+	if rowsAffected == 0 {
+		// Tokens handed out to consumer groups only acknowledge the message
+		// for that group; cleanup deletes it once every group is done
+		var queueName string
+		var messageID int64
+		err = tx.QueryRow("SELECT queue_name, message_id FROM group_deliveries WHERE delete_token = ?", deleteToken).Scan(&queueName, &messageID)
+		if err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return false, fmt.Errorf("failed to select group delivery: %w", err)
+		}
+		if err == nil {
+			result, err = tx.Exec("UPDATE group_deliveries SET acked = 1, delete_token = NULL WHERE delete_token = ?", deleteToken)
+			if err != nil {
+				tx.Rollback()
+				return false, fmt.Errorf("failed to acknowledge group delivery: %w", err)
+			}
+			rowsAffected, err = result.RowsAffected()
+			if err != nil {
+				tx.Rollback()
+				return false, fmt.Errorf("failed to retrieve rows affected: %w", err)
+			}
+			if err := addQueueCounter(tx, queueName, "delete_count", int(rowsAffected)); err != nil {
+				tx.Rollback()
+				return false, err
+			}
+			deletedQueue, deletedID = queueName, messageID
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if rowsAffected > 0 {
+		mq.events.publish(EventDeleted, deletedQueue, deletedID)
+	}
+	if receiptURL.Valid {
+		now := time.Now()
+		enqueuedAt := time.Unix(0, createdAt)
+		queueReceipt(receiptURL.String, Receipt{
+			QueueName:  deletedQueue,
+			MessageID:  deletedID,
+			EnqueuedAt: enqueuedAt,
+			DeletedAt:  now,
+			LatencyMs:  now.Sub(enqueuedAt).Milliseconds(),
+		})
+	}
+	return rowsAffected > 0, nil
+}
+
+var receiptClient = &http.Client{Timeout: receiptTimeout, Transport: callbackTransport()}
+
+// callbackHosts holds the hosts given with --callback-hosts, lowercased.
+var callbackHosts = map[string]bool{}
+
+// callbackAllowPrivate is set by --callback-allow-private.
+var callbackAllowPrivate bool
+
+// receiptSlots bounds the number of receipts being sent at once.
+var receiptSlots = make(chan struct{}, maxPendingReceipts)
+
+// callbackHostAllowed reports whether rawURL points to a host listed in
+// --callback-hosts. Nothing is allowed when the flag isn't given.
+func callbackHostAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); ip != nil && privateCallbackIP(ip) {
+		return false
+	}
+	return callbackHosts[host]
+}
+
+// privateCallbackIP reports whether receipts and pushes must not go to ip:
+// a loopback, private, link-local or unspecified address, unless
+// --callback-allow-private is given.
+func privateCallbackIP(ip net.IP) bool {
+	if callbackAllowPrivate {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// callbackTransport returns the transport of receipt and push requests. It
+// checks the address every connection actually goes to, so an allowed host
+// name that resolves into the server's own network is refused as well, and
+// doesn't use a proxy, whose address is all the check would see.
+func callbackTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || privateCallbackIP(ip) {
+				return fmt.Errorf("refusing to connect to private address %s", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// queueReceipt sends receipt to url in the background. The host is checked
+// again, since the message may have been enqueued under another
+// --callback-hosts, and the receipt is dropped when maxPendingReceipts are
+// already being sent, so slow receivers can't pile up goroutines.
+func queueReceipt(url string, receipt Receipt) {
+	if !callbackHostAllowed(url) {
+		log.Printf("Dropped receipt for message %d of queue %s: host is not in --callback-hosts", receipt.MessageID, receipt.QueueName)
+		return
+	}
+	select {
+	case receiptSlots <- struct{}{}:
+		go func() {
+			defer func() { <-receiptSlots }()
+			sendReceipt(url, receipt)
+		}()
+	default:
+		log.Printf("Dropped receipt for message %d of queue %s: %d receipts are already pending", receipt.MessageID, receipt.QueueName, maxPendingReceipts)
+	}
+}
+
+// sendReceipt posts receipt to url, retrying up to receiptAttempts times
+// until the receiver answers with a 2xx status.
+func sendReceipt(url string, receipt Receipt) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		log.Printf("Failed to encode receipt for message %d: %v", receipt.MessageID, err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := receiptClient.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("receiver responded with %s", resp.Status)
+		}
+		if attempt == receiptAttempts {
+			log.Printf("Giving up on receipt for message %d of queue %s after %d attempts: %v", receipt.MessageID, receipt.QueueName, attempt, err)
+			return
+		}
+		time.Sleep(receiptRetryDelay * time.Duration(attempt))
+	}
+}
+
+// PushStatus describes the push delivery of a queue, as shown on /stats.
+type PushStatus struct {
+	QueueName       string    `json:"queue_name"`
+	PushURL         string    `json:"push_url"`
+	Concurrency     int       `json:"concurrency"`
+	Delivered       int       `json:"delivered"`
+	Failed          int       `json:"failed"`
+	LastDeliveredAt time.Time `json:"last_delivered_at"`
+	LastFailedAt    time.Time `json:"last_failed_at"`
+	LastError       string    `json:"last_error"`
+}
+
+// pushSubscription is the running push delivery of a queue. Its workers
+// exit once stop is closed.
+type pushSubscription struct {
+	client  *http.Client
+	timeout time.Duration
+	stop    chan struct{}
+	lock    sync.Mutex // Guards status
+	status  PushStatus
+}
+
+// startPushTask keeps the push workers in line with the queue configs.
+func (mq *MessageQueue) startPushTask() {
+	defer mq.tasks.Done()
+
+	for {
+		mq.syncPushSubscriptions()
+		if !mq.sleep(pushSyncInterval) {
+			return
+		}
+	}
+}
+
+// syncPushSubscriptions starts push delivery for the queues that have a
+// push_url and stops it for those that no longer do. A subscription whose
+// settings changed is restarted, which resets its counters.
+func (mq *MessageQueue) syncPushSubscriptions() {
+	mq.pushSyncLock.Lock()
+	defer mq.pushSyncLock.Unlock()
+
+	// Read before taking pushLock, which /stats needs, since reading the
+	// configs waits for the queue lock
+	configs, err := mq.ExportQueueConfigs()
+	if err != nil {
+		log.Printf("Failed to sync push subscriptions: %v", err)
+		return
+	}
+
+	mq.pushLock.Lock()
+	defer mq.pushLock.Unlock()
+
+	for queueName, sub := range mq.pushSubscriptions {
+		config, ok := configs[queueName]
+		if ok && config.PushURL == sub.status.PushURL && config.pushConcurrency() == sub.status.Concurrency && config.pushTimeout() == sub.timeout {
+			continue
+		}
+		close(sub.stop)
+		delete(mq.pushSubscriptions, queueName)
+		log.Printf("Stopped pushing messages of queue %s to %s", queueName, sub.status.PushURL)
+	}
+
+	for queueName, config := range configs {
+		if config.PushURL == "" || mq.pushSubscriptions[queueName] != nil {
+			continue
+		}
+		if !callbackHostAllowed(config.PushURL) {
+			log.Printf("Not pushing messages of queue %s: host of %s is not allowed by --callback-hosts", queueName, config.PushURL)
+			continue
+		}
+		sub := &pushSubscription{
+			client:  &http.Client{Timeout: config.pushTimeout(), Transport: callbackTransport()},
+			timeout: config.pushTimeout(),
+			stop:    make(chan struct{}),
+			status:  PushStatus{QueueName: queueName, PushURL: config.PushURL, Concurrency: config.pushConcurrency()},
+		}
+		mq.pushSubscriptions[queueName] = sub
+		mq.tasks.Add(sub.status.Concurrency)
+		for i := 0; i < sub.status.Concurrency; i++ {
+			go mq.runPushWorker(sub)
+		}
+		log.Printf("Pushing messages of queue %s to %s with %d workers", queueName, config.PushURL, sub.status.Concurrency)
+	}
+}
+
+// runPushWorker delivers messages of the subscription's queue one at a time
+// until the subscription is stopped. Each message stays leased for a little
+// longer than the push may take, so it isn't redelivered meanwhile, and goes
+// through the usual receive count and poison handling of dequeues.
+func (mq *MessageQueue) runPushWorker(sub *pushSubscription) {
+	defer mq.tasks.Done()
+
+	queueName := sub.status.QueueName
+	visibilityTimeout := int(sub.timeout/time.Second) + pushLeaseMargin
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-mq.done:
+			return
+		default:
+		}
+
+		msg, err := mq.Dequeue(queueName, visibilityTimeout, 1, false, "push", "")
+		if err != nil {
+			log.Printf("Failed to dequeue message of queue %s for push: %v", queueName, err)
+		}
+		if msg == nil {
+			select {
+			case <-sub.stop:
+				return
+			case <-mq.done:
+				return
+			case <-time.After(pushIdleInterval):
+			}
+			continue
+		}
+
+		err = sub.push(msg)
+		if err == nil {
+			if _, err := mq.DeleteMessage(msg.DeleteToken); err != nil {
+				log.Printf("Failed to delete pushed message %d of queue %s: %v", msg.MessageID, queueName, err)
+			}
+			continue
+		}
+		if _, err := mq.Fail(msg.DeleteToken, false, nil); err != nil {
+			log.Printf("Failed to release message %d of queue %s after a failed push: %v", msg.MessageID, queueName, err)
+		}
+	}
+}
+
+// push posts msg to the subscription's push_url and records the outcome. The
+// body is the message as enqueued; its id and receive count go in headers.
+func (sub *pushSubscription) push(msg *DequeuedMessage) error {
+	req, err := http.NewRequest(http.MethodPost, sub.status.PushURL, bytes.NewReader(msg.Message))
+	if err != nil {
+		return sub.record(fmt.Errorf("failed to create push request: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Sasquatch-Queue", sub.status.QueueName)
+	req.Header.Set("X-Sasquatch-Message-Id", strconv.Itoa(msg.MessageID))
+	req.Header.Set("X-Sasquatch-Priority", strconv.Itoa(msg.Priority))
+	req.Header.Set("X-Sasquatch-Receive-Count", strconv.Itoa(msg.ReceiveCount))
+
+	resp, err := sub.client.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err = fmt.Errorf("receiver responded with %s", resp.Status)
+		}
+	}
+	return sub.record(err)
+}
+
+// record counts a push as delivered if err is nil and as failed otherwise,
+// and returns err.
+func (sub *pushSubscription) record(err error) error {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	if err == nil {
+		sub.status.Delivered++
+		sub.status.LastDeliveredAt = time.Now()
+		return nil
+	}
+	sub.status.Failed++
+	sub.status.LastFailedAt = time.Now()
+	sub.status.LastError = err.Error()
+	return err
+}
+
+// GetPushStatuses returns the status of every running push subscription,
+// sorted by queue name.
+func (mq *MessageQueue) GetPushStatuses() []PushStatus {
+	mq.pushLock.Lock()
+	defer mq.pushLock.Unlock()
+
+	statuses := make([]PushStatus, 0, len(mq.pushSubscriptions))
+	for _, sub := range mq.pushSubscriptions {
+		sub.lock.Lock()
+		statuses = append(statuses, sub.status)
+		sub.lock.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].QueueName < statuses[j].QueueName })
+	return statuses
+}
+
+// Reroute moves the message leased out under deleteToken to destQueue in one
+// transaction, as a fresh message that was never received, and returns its
+// id there. The old delete token stops working. Consumer group deliveries
+// can't be rerouted, since the message belongs to the other groups too.
+func (mq *MessageQueue) Reroute(deleteToken, destQueue string) (int64, error) {
+	claims, err := mq.parseDeleteToken(deleteToken)
+	if err != nil {
+		return 0, err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	if err := mq.ensureMessageTable(destQueue); err != nil {
+		return 0, err
+	}
+	destTable, _ := mq.messageTable(destQueue)
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	table, queueName, id, err := mq.findLeasedMessage(tx, deleteToken, claims)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if queueName == destQueue {
+		tx.Rollback()
+		return 0, ErrSameQueue
+	}
+
+	insertStmt := `
+		INSERT INTO ` + destTable + ` (queue_name, message, priority, created_at, encrypted, nonce, body_hash, receipt_url, blob_ref, dedup_id, key_id, sort_key)
+		SELECT ?, message, priority, created_at, encrypted, nonce, body_hash, receipt_url, blob_ref, dedup_id, key_id, sort_key FROM ` + table + ` WHERE id = ?
+	`
+	result, err := tx.Exec(insertStmt, destQueue, id)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to copy message to %s: %w", destQueue, err)
+	}
+	newID, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to retrieve message id: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM "+table+" WHERE id = ?", id)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to delete rerouted message: %w", err)
+	}
+
+	if err := addQueueCounter(tx, queueName, "delete_count", 1); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := addQueueCounter(tx, destQueue, "enqueue_count", 1); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	mq.lengths.forget(queueName)
+	mq.lengths.forget(destQueue)
+	mq.enqueueSeq++
+	mq.cond.Broadcast()
+	mq.events.publish(EventDeleted, queueName, int64(id))
+	mq.events.publish(EventEnqueued, destQueue, newID)
+	return newID, nil
+}
+
+// Fail reports that processing the message leased out under deleteToken
+// failed. A permanent failure moves the message to its queue's dead letter
+// queue right away, whatever its receive count, and is counted in the
+// queue's permanent_failure_count. A transient one releases the message, to
+// be redelivered after the queue's redelivery delay and retry backoff
+// instead of after the rest of its visibility timeout, with newPriority
+// unless that is nil, in the same transaction. Consumer group deliveries
+// can't be failed.
+func (mq *MessageQueue) Fail(deleteToken string, permanent bool, newPriority *int) (FailResponse, error) {
+	claims, err := mq.parseDeleteToken(deleteToken)
+	if err != nil {
+		return FailResponse{}, err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	// The dead letter queue's table must not be created while a
+	// transaction is open, so look the message up first
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return FailResponse{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	table, queueName, id, err := mq.findLeasedMessage(tx, deleteToken, claims)
+	if err != nil {
+		tx.Rollback()
+		return FailResponse{}, err
+	}
+	config, err := mq.queueConfig(tx, queueName)
+	tx.Rollback()
+	if err != nil {
+		return FailResponse{}, err
+	}
+
+	if permanent {
+		if config.DeadLetterQueue == "" {
+			return FailResponse{}, ErrNoDeadLetterQueue
+		}
+		if err := mq.ensureMessageTable(config.DeadLetterQueue); err != nil {
+			return FailResponse{}, err
+		}
+	}
+
+	tx, err = mq.db.Begin()
+	if err != nil {
+		return FailResponse{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	response := FailResponse{QueueName: queueName, MessageID: int64(id), DeadLettered: permanent}
+	var receiveCount int
+	err = tx.QueryRow("SELECT receive_count, priority FROM "+table+" WHERE id = ?", id).Scan(&receiveCount, &response.Priority)
+	if err != nil {
+		tx.Rollback()
+		return FailResponse{}, fmt.Errorf("failed to select message: %w", err)
+	}
+
+	if permanent {
+		ids, err := mq.deadLetterMessages(tx, table, config.DeadLetterQueue, "id = ? AND delete_token = ?", id, deleteToken)
+		if err == nil && len(ids) == 0 {
+			err = ErrMessageNotFound
+		}
+		if err == nil {
+			err = addQueueCounter(tx, queueName, "permanent_failure_count", 1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return FailResponse{}, err
+		}
+	} else {
+		if newPriority != nil {
+			response.Priority = *newPriority
+		}
+		response.RetryInSeconds = config.leaseSeconds(0, receiveCount)
+		updateStmt := "UPDATE " + table + " SET visibility_timestamp = ?, priority = ?, delete_token = NULL, lease_owner = NULL, processing_label = NULL WHERE id = ?"
+		_, err = tx.Exec(updateStmt, time.Now().Unix()+int64(response.RetryInSeconds), response.Priority, id)
+		if err != nil {
+			tx.Rollback()
+			return FailResponse{}, fmt.Errorf("failed to release message: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return FailResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	mq.lengths.forget(queueName)
+	if permanent {
+		mq.lengths.forget(config.DeadLetterQueue)
+	}
+	mq.enqueueSeq++
+	mq.cond.Broadcast()
+	if permanent {
+		mq.events.publish(EventDeadLettered, queueName, int64(id))
+	}
+	return response, nil
+}
+
+// ReleaseMessage hands the message leased out under deleteToken back to its
+// queue, visible right away, for a consumer that can't process it now. Its
+// receive count stays where the dequeue left it and the delete token stops
+// working. Consumer group deliveries are released to their group. It
+// returns false if no message is leased under the token.
+func (mq *MessageQueue) ReleaseMessage(deleteToken string) (bool, error) {
+	claims, err := mq.parseDeleteToken(deleteToken)
+	if err != nil {
+		return false, err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var result sql.Result
+	table, queueName, id, err := mq.findLeasedMessage(tx, deleteToken, claims)
+	switch err {
+	case nil:
+		updateStmt := "UPDATE " + table + " SET visibility_timestamp = 0, delete_token = NULL, lease_owner = NULL, processing_label = NULL WHERE id = ?"
+		result, err = tx.Exec(updateStmt, id)
+	case ErrMessageNotFound:
+		result, err = tx.Exec("UPDATE group_deliveries SET visibility_timestamp = 0, delete_token = NULL WHERE delete_token = ? AND acked = 0", deleteToken)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to release message: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("failed to retrieve rows affected: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return false, nil
+	}
+	if queueName != "" {
+		mq.lengths.forget(queueName)
+	}
+	mq.enqueueSeq++
+	mq.cond.Broadcast() // Signal waiting dequeue requests
+	return true, nil
+}
+
+// Heartbeat extends the lease of the message leased out under deleteToken
+// to timeoutSeconds from now and records the time of the heartbeat. A
+// consumer that dequeues with a short visibility timeout and keeps sending
+// heartbeats holds the message for as long as it works on it, while the
+// message is redelivered soon after the heartbeats stop. With signed tokens
+// a new token is issued, since the old one expires with the old lease.
+func (mq *MessageQueue) Heartbeat(deleteToken string, timeoutSeconds int) (HeartbeatResponse, error) {
+	claims, err := mq.parseDeleteToken(deleteToken)
+	if err != nil {
+		return HeartbeatResponse{}, err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return HeartbeatResponse{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	table, queueName, id, err := mq.findLeasedMessage(tx, deleteToken, claims)
+	if err != nil {
+		tx.Rollback()
+		return HeartbeatResponse{}, err
+	}
+
+	now := time.Now()
+	var visibilityTimestamp int64
+	var leasedAt sql.NullInt64
+	err = tx.QueryRow("SELECT visibility_timestamp, leased_at FROM "+table+" WHERE id = ?", id).Scan(&visibilityTimestamp, &leasedAt)
+	if err != nil {
+		tx.Rollback()
+		return HeartbeatResponse{}, fmt.Errorf("failed to select message: %w", err)
+	}
+	if visibilityTimestamp <= now.Unix() {
+		tx.Rollback()
+		return HeartbeatResponse{}, ErrLeaseExpired
+	}
+
+	config, err := mq.queueConfig(tx, queueName)
+	if err != nil {
+		tx.Rollback()
+		return HeartbeatResponse{}, err
+	}
+
+	expiresAt := now.Unix() + int64(timeoutSeconds)
+
+	// Heartbeats can't extend the lease past the queue's cap, and once it is
+	// reached the message is made visible for redelivery right away
+	if config.MaxLeaseSeconds > 0 && leasedAt.Valid {
+		deadline := leasedAt.Int64 + int64(config.MaxLeaseSeconds)
+		if now.Unix() >= deadline {
+			_, err = tx.Exec("UPDATE "+table+" SET visibility_timestamp = ? WHERE id = ?", now.Unix(), id)
+			if err != nil {
+				tx.Rollback()
+				return HeartbeatResponse{}, fmt.Errorf("failed to end lease: %w", err)
+			}
+			if err := tx.Commit(); err != nil {
+				return HeartbeatResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+			}
+			mq.lengths.forget(queueName)
+			mq.enqueueSeq++
+			mq.cond.Broadcast()
+			return HeartbeatResponse{}, ErrLeaseCapReached
+		}
+		if expiresAt > deadline {
+			expiresAt = deadline
+		}
+	}
+
+	newToken := deleteToken
+	if claims != nil {
+		newToken = mq.newDeleteToken(queueName, id, expiresAt)
+	}
+	_, err = tx.Exec("UPDATE "+table+" SET visibility_timestamp = ?, delete_token = ?, last_heartbeat_at = ? WHERE id = ?", expiresAt, newToken, now.UnixNano(), id)
+	if err != nil {
+		tx.Rollback()
+		return HeartbeatResponse{}, fmt.Errorf("failed to extend lease: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return HeartbeatResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return HeartbeatResponse{QueueName: queueName, MessageID: id, DeleteToken: newToken, ExpiresAt: time.Unix(expiresAt, 0)}, nil
+}
+
+// ChangeVisibility hides the message leased out under deleteToken until
+// seconds from now. Unlike Heartbeat it also extends a lease that has
+// already run out, as long as the message hasn't been dequeued again, since
+// that replaces its delete token. Like Heartbeat it issues a new signed
+// token, since the old one expires with the old lease.
+func (mq *MessageQueue) ChangeVisibility(deleteToken string, seconds int) (ExtendVisibilityResponse, error) {
+	claims, err := mq.parseDeleteToken(deleteToken)
+	if err != nil {
+		return ExtendVisibilityResponse{}, err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return ExtendVisibilityResponse{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	table, queueName, id, err := mq.findLeasedMessage(tx, deleteToken, claims)
+	if err != nil {
+		tx.Rollback()
+		return ExtendVisibilityResponse{}, err
+	}
+
+	var leasedAt sql.NullInt64
+	err = tx.QueryRow("SELECT leased_at FROM "+table+" WHERE id = ?", id).Scan(&leasedAt)
+	if err != nil {
+		tx.Rollback()
+		return ExtendVisibilityResponse{}, fmt.Errorf("failed to select message: %w", err)
+	}
+
+	config, err := mq.queueConfig(tx, queueName)
+	if err != nil {
+		tx.Rollback()
+		return ExtendVisibilityResponse{}, err
+	}
+
+	now := time.Now()
+	visibilityTimestamp := now.Unix() + int64(seconds)
+
+	// The queue's lease cap applies here as it does to heartbeats
+	if config.MaxLeaseSeconds > 0 && leasedAt.Valid {
+		deadline := leasedAt.Int64 + int64(config.MaxLeaseSeconds)
+		if now.Unix() >= deadline {
+			_, err = tx.Exec("UPDATE "+table+" SET visibility_timestamp = ? WHERE id = ?", now.Unix(), id)
+			if err != nil {
+				tx.Rollback()
+				return ExtendVisibilityResponse{}, fmt.Errorf("failed to end lease: %w", err)
+			}
+			if err := tx.Commit(); err != nil {
+				return ExtendVisibilityResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+			}
+			mq.lengths.forget(queueName)
+			mq.enqueueSeq++
+			mq.cond.Broadcast()
+			return ExtendVisibilityResponse{}, ErrLeaseCapReached
+		}
+		if visibilityTimestamp > deadline {
+			visibilityTimestamp = deadline
+		}
+	}
+
+	newToken := deleteToken
+	if claims != nil {
+		newToken = mq.newDeleteToken(queueName, id, visibilityTimestamp)
+	}
+	_, err = tx.Exec("UPDATE "+table+" SET visibility_timestamp = ?, delete_token = ?, last_heartbeat_at = ? WHERE id = ?", visibilityTimestamp, newToken, now.UnixNano(), id)
+	if err != nil {
+		tx.Rollback()
+		return ExtendVisibilityResponse{}, fmt.Errorf("failed to change visibility: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return ExtendVisibilityResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	// The lease may have run out already, so the message may have been
+	// counted as visible until now
+	mq.lengths.forget(queueName)
+	return ExtendVisibilityResponse{QueueName: queueName, MessageID: id, DeleteToken: newToken, ExpiresAt: time.Unix(visibilityTimestamp, 0)}, nil
+}
+
+// SetLabel sets the processing label of the message leased under
+// deleteToken, so operators can see on /inflight what its consumer is doing.
+// An empty label removes it. The lease itself is left unchanged.
+func (mq *MessageQueue) SetLabel(deleteToken, label string) (SetLabelResponse, error) {
+	claims, err := mq.parseDeleteToken(deleteToken)
+	if err != nil {
+		return SetLabelResponse{}, err
+	}
+
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return SetLabelResponse{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	table, queueName, id, err := mq.findLeasedMessage(tx, deleteToken, claims)
+	if err != nil {
+		tx.Rollback()
+		return SetLabelResponse{}, err
+	}
+
+	result, err := tx.Exec("UPDATE "+table+" SET processing_label = ? WHERE id = ? AND visibility_timestamp > ?", nullableString(label), id, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return SetLabelResponse{}, fmt.Errorf("failed to set processing label: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		tx.Rollback()
+		return SetLabelResponse{}, ErrLeaseExpired
+	}
+
+	if err := tx.Commit(); err != nil {
+		return SetLabelResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return SetLabelResponse{QueueName: queueName, MessageID: id, ProcessingLabel: label}, nil
+}
+
+// ActiveConsumers counts the distinct lease owners holding in-flight messages
+// of queueName. Consumer group deliveries are not included.
+func (mq *MessageQueue) ActiveConsumers(queueName string) (ActiveConsumersResponse, error) {
+	response := ActiveConsumersResponse{QueueName: queueName}
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return response, nil
+	}
+
+	db := mq.reader()
+
+	stmt := `
+		SELECT COUNT(DISTINCT lease_owner), COUNT(*) - COUNT(lease_owner)
+		FROM ` + table + `
+		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp > ? AND receive_count > 0
+	`
+	err := db.QueryRow(stmt, queueName, time.Now().Unix()).Scan(&response.ActiveConsumers, &response.UnownedInFlight)
+	if isMissingTable(err) {
+		return response, nil
+	}
+	if err != nil {
+		return response, fmt.Errorf("failed to count active consumers: %w", err)
+	}
+	return response, nil
+}
+
+// GetInFlight lists up to limit in-flight messages of queueName, those whose
+// lease ends first coming first. Consumer group deliveries are not included.
+func (mq *MessageQueue) GetInFlight(queueName string, limit int) ([]InFlightMessage, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	result := []InFlightMessage{}
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return result, nil
+	}
+
+	stmt := `
+		SELECT id, priority, receive_count, leased_at, visibility_timestamp, last_heartbeat_at, lease_owner, processing_label
+		FROM ` + table + `
+		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp > ? AND receive_count > 0
+		ORDER BY visibility_timestamp, id LIMIT ?
+	`
+	rows, err := mq.db.Query(stmt, queueName, time.Now().Unix(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query in-flight messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m InFlightMessage
+		var leasedAt, lastHeartbeatAt sql.NullInt64
+		var visibilityTimestamp int64
+		var leaseOwner, label sql.NullString
+		if err := rows.Scan(&m.MessageID, &m.Priority, &m.ReceiveCount, &leasedAt, &visibilityTimestamp, &lastHeartbeatAt, &leaseOwner, &label); err != nil {
+			return nil, fmt.Errorf("failed to scan in-flight message: %w", err)
+		}
+		if leasedAt.Valid {
+			t := time.Unix(leasedAt.Int64, 0)
+			m.LeasedAt = &t
+		}
+		if lastHeartbeatAt.Valid {
+			t := time.Unix(0, lastHeartbeatAt.Int64)
+			m.LastHeartbeatAt = &t
+		}
+		m.ExpiresAt = time.Unix(visibilityTimestamp, 0)
+		m.LeaseOwner = leaseOwner.String
+		m.ProcessingLabel = label.String
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// WaitEmpty blocks until queueName holds no pending messages, visible or in
+// flight, and reports whether that happened before ctx was done.
+func (mq *MessageQueue) WaitEmpty(ctx context.Context, queueName string) (bool, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	// Taking the lock before broadcasting ensures the wakeup can't slip in
+	// between the check below and the wait
+	wake := func() {
+		mq.lock.Lock()
+		mq.cond.Broadcast()
+		mq.lock.Unlock()
+	}
+	stop := context.AfterFunc(ctx, wake)
+	defer stop()
+
+	for {
+		table, ok := mq.messageTable(queueName)
+		if !ok {
+			return true, nil
+		}
+		var count int
+		err := mq.db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE queue_name = ? AND processed = 0", queueName).Scan(&count)
+		if err != nil {
+			return false, fmt.Errorf("failed to count pending messages: %w", err)
+		}
+		if count == 0 {
+			return true, nil
+		}
+		if ctx.Err() != nil {
+			return false, nil
+		}
+
+		// Deletes wake us right away; the timer catches messages that leave
+		// the queue any other way, such as cleanup or poison message removal
+		timer := time.AfterFunc(waitEmptyCheckInterval, wake)
+		mq.cond.Wait()
+		timer.Stop()
+	}
+}
+
+func (mq *MessageQueue) DeleteAllMessages(queueName string) error {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	defer mq.lengths.forget(queueName)
+	if mq.tablePerQueue {
+		return mq.dropQueueTables(queueName)
+	}
+
+	var deleteStmt string
+	if queueName == "*" {
+		deleteStmt = "DELETE FROM messages"
+	} else {
+		deleteStmt = "DELETE FROM messages WHERE queue_name = ?"
+	}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if queueName == "*" {
+		_, err = tx.Exec(deleteStmt)
+	} else {
+		_, err = tx.Exec(deleteStmt, queueName)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to execute delete statement: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// dropQueueTables removes the table of queueName, or of every queue for "*",
+// in table-per-queue mode. Must be called with the lock held.
+func (mq *MessageQueue) dropQueueTables(queueName string) error {
+	var tables []string
+	if queueName == "*" {
+		tables = mq.messageTables()
+	} else if table, ok := mq.messageTable(queueName); ok {
+		tables = []string{table}
+	}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	for _, table := range tables {
+		if _, err := tx.Exec("DROP TABLE " + table); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to drop queue table: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	mq.tablesLock.Lock()
+	for _, table := range tables {
+		delete(mq.tables, table)
+	}
+	mq.tablesLock.Unlock()
+	return nil
+}
+
+// CountAllMessages reports, per queue, how many messages DeleteAllMessages
+// would remove for the same queueName, including in-flight messages.
+func (mq *MessageQueue) CountAllMessages(queueName string) ([]QueueLengthResponse, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	var tables []string
+	if queueName == "*" {
+		tables = mq.messageTables()
+	} else if table, ok := mq.messageTable(queueName); ok {
+		tables = []string{table}
+	}
+
+	result := []QueueLengthResponse{}
+	for _, table := range tables {
+		var rows *sql.Rows
+		var err error
+		if queueName == "*" {
+			rows, err = mq.db.Query("SELECT queue_name, COUNT(*) FROM " + table + " GROUP BY queue_name")
+		} else {
+			rows, err = mq.db.Query("SELECT queue_name, COUNT(*) FROM "+table+" WHERE queue_name = ? GROUP BY queue_name", queueName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to count messages: %w", err)
+		}
+
+		for rows.Next() {
+			var count QueueLengthResponse
+			if err := rows.Scan(&count.QueueName, &count.Count); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan queue name and count: %w", err)
+			}
+			result = append(result, count)
+		}
+		rows.Close()
+	}
+	return result, nil
+}
+
+// Reprioritize sets the priority of the visible messages in queueName,
+// optionally narrowed to specific message ids and/or a current priority, and
+// returns how many messages were changed.
+func (mq *MessageQueue) Reprioritize(queueName string, messageIDs []int, fromPriority *int, priority int) (int, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, nil
+	}
+
+	updateStmt := "UPDATE " + table + " SET priority = ? WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ?"
+	args := []interface{}{priority, queueName, time.Now().Unix()}
+	if len(messageIDs) > 0 {
+		updateStmt += " AND id IN (?" + strings.Repeat(", ?", len(messageIDs)-1) + ")"
+		for _, id := range messageIDs {
+			args = append(args, id)
+		}
+	}
+	if fromPriority != nil {
+		updateStmt += " AND priority = ?"
+		args = append(args, *fromPriority)
+	}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	result, err := tx.Exec(updateStmt, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to execute reprioritize statement: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve rows affected: %w", err)
+	}
+	return int(rowsAffected), nil
+}
+
+// Replay makes the retained processed messages of queueName that were
+// processed between from and to visible again, with a fresh receive count,
+// and returns how many it replayed.
+func (mq *MessageQueue) Replay(queueName string, from, to time.Time) (int, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, nil
+	}
+
+	updateStmt := `
+		UPDATE ` + table + `
+		SET processed = 0, processed_at = NULL, visibility_timestamp = 0, delete_token = NULL, receive_count = 0, lease_owner = NULL
+		WHERE queue_name = ? AND processed = 1 AND processed_at >= ? AND processed_at <= ?
+	`
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	result, err := tx.Exec(updateStmt, queueName, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("failed to execute replay statement: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve rows affected: %w", err)
+	}
+	if rowsAffected > 0 {
+		mq.lengths.forget(queueName)
+		mq.enqueueSeq++
+		mq.cond.Broadcast()
+	}
+	return int(rowsAffected), nil
+}
+
+// RecoverStuck finds messages of queueName that were delivered before but
+// whose lease ran out more than stuckFor ago without anyone dequeueing them
+// again, which points at a queue without working consumers. Depending on
+// action it only counts them, resets their receive count and lease, or moves
+// them to the queue's dead letter queue. It returns how many messages were
+// affected.
+func (mq *MessageQueue) RecoverStuck(queueName string, stuckFor time.Duration, action string) (int, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, nil
+	}
+
+	config, err := mq.GetQueueConfig(queueName)
+	if err != nil {
+		return 0, err
+	}
+	if action == RecoverDeadLetter {
+		if config.DeadLetterQueue == "" {
+			return 0, ErrNoDeadLetterQueue
+		}
+		if err := mq.ensureMessageTable(config.DeadLetterQueue); err != nil {
+			return 0, err
+		}
+	}
+
+	where := "queue_name = ? AND processed = 0 AND receive_count > 0 AND visibility_timestamp <= ?"
+	args := []interface{}{queueName, time.Now().Add(-stuckFor).Unix()}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var affected int64
+	var deadLettered []int64
+	switch action {
+	case RecoverCount:
+		err = tx.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+where, args...).Scan(&affected)
+		if err != nil {
+			err = fmt.Errorf("failed to count stuck messages: %w", err)
+		}
+	case RecoverReset:
+		var result sql.Result
+		result, err = tx.Exec("UPDATE "+table+" SET receive_count = 0, delete_token = NULL, lease_owner = NULL WHERE "+where, args...)
+		if err != nil {
+			err = fmt.Errorf("failed to reset stuck messages: %w", err)
+		} else {
+			affected, err = result.RowsAffected()
+		}
+	case RecoverDeadLetter:
+		deadLettered, err = mq.deadLetterMessages(tx, table, config.DeadLetterQueue, where, args...)
+		affected = int64(len(deadLettered))
+	default:
+		err = fmt.Errorf("unknown recover action %q", action)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if action == RecoverDeadLetter && affected > 0 {
+		mq.lengths.forget(queueName)
+		mq.lengths.forget(config.DeadLetterQueue)
+		mq.enqueueSeq++
+		mq.cond.Broadcast()
+		mq.events.publish(EventDeadLettered, queueName, deadLettered...)
+	}
+	return int(affected), nil
+}
+
+// PurgePoison deletes, or moves to the queue's dead letter queue depending
+// on action, the visible messages of queueName that were received at least
+// minReceiveCount times, and returns how many it removed. Deleted messages
+// count as dropped poison messages. In-flight messages are left alone, since
+// their current delivery may still succeed.
+func (mq *MessageQueue) PurgePoison(queueName string, minReceiveCount int, action string) (int, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, nil
+	}
+
+	config, err := mq.GetQueueConfig(queueName)
+	if err != nil {
+		return 0, err
+	}
+	if action == PurgeDeadLetter {
+		if config.DeadLetterQueue == "" {
+			return 0, ErrNoDeadLetterQueue
+		}
+		if err := mq.ensureMessageTable(config.DeadLetterQueue); err != nil {
+			return 0, err
+		}
+	}
+
+	where := "queue_name = ? AND processed = 0 AND receive_count >= ? AND visibility_timestamp <= ?"
+	args := []interface{}{queueName, minReceiveCount, time.Now().Unix()}
+
+	tx, err := mq.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	var affected int64
+	var deadLettered []int64
+	switch action {
+	case PurgeDelete:
+		var result sql.Result
+		result, err = tx.Exec("DELETE FROM "+table+" WHERE "+where, args...)
+		if err != nil {
+			err = fmt.Errorf("failed to delete poison messages: %w", err)
+			break
+		}
+		affected, err = result.RowsAffected()
+		if err == nil && affected > 0 {
+			err = addQueueCounter(tx, queueName, "poison_drop_count", int(affected))
+		}
+	case PurgeDeadLetter:
+		deadLettered, err = mq.deadLetterMessages(tx, table, config.DeadLetterQueue, where, args...)
+		affected = int64(len(deadLettered))
+	default:
+		err = fmt.Errorf("unknown purge action %q", action)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if affected > 0 {
+		mq.lengths.forget(queueName)
+	}
+	if action == PurgeDeadLetter && affected > 0 {
+		mq.lengths.forget(config.DeadLetterQueue)
+		mq.enqueueSeq++
+		mq.cond.Broadcast()
+		mq.events.publish(EventDeadLettered, queueName, deadLettered...)
+	}
+	return int(affected), nil
+}
+
+// deadLetterMessages moves the messages of table matching where into the
+// table of deadLetterQueue within tx, as fresh messages that were never
+// received, and returns the ids they had. where must restrict the messages
+// to a queue other than deadLetterQueue. The dead letter queue's length
+// limits don't apply, so that no message is lost. Its table must already
+// exist.
+func (mq *MessageQueue) deadLetterMessages(tx *sql.Tx, table, deadLetterQueue, where string, args ...interface{}) ([]int64, error) {
+	deadLetterTable, _ := mq.messageTable(deadLetterQueue)
+
+	rows, err := tx.Query("SELECT id FROM "+table+" WHERE "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select messages to dead-letter: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan message id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	insertStmt := `
+		INSERT INTO ` + deadLetterTable + ` (queue_name, message, priority, created_at, encrypted, nonce, body_hash, receipt_url, blob_ref, dedup_id, key_id, sort_key)
+		SELECT ?, message, priority, created_at, encrypted, nonce, body_hash, receipt_url, blob_ref, dedup_id, key_id, sort_key FROM ` + table + `
+		WHERE ` + where
+	_, err = tx.Exec(insertStmt, append([]interface{}{deadLetterQueue}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy messages to dead letter queue: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM "+table+" WHERE "+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete dead-lettered messages: %w", err)
+	}
+	return ids, nil
+}
+
+// GetPosition returns the place of a visible message of queueName in
+// dequeue order, 1 meaning the next dequeue gets it. Visible messages
+// count as ahead of it if Dequeue would hand them out first.
+func (mq *MessageQueue) GetPosition(queueName string, messageID int64) (int, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, ErrMessageNotFound
+	}
+	return messagePosition(mq.db, table, queueName, messageID)
+}
+
+// messagePosition returns the place of a visible message of queueName in
+// table in dequeue order, or ErrMessageInFlight if it isn't visible.
+func messagePosition(q querier, table, queueName string, messageID int64) (int, error) {
+	var priority int
+	var createdAt, visibilityTimestamp int64
+	var sortKey sql.NullFloat64
+	err := q.QueryRow("SELECT priority, created_at, visibility_timestamp, sort_key FROM "+table+" WHERE id = ? AND queue_name = ? AND processed = 0", messageID, queueName).Scan(&priority, &createdAt, &visibilityTimestamp, &sortKey)
+	if err == sql.ErrNoRows {
+		return 0, ErrMessageNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to select message: %w", err)
+	}
+	now := time.Now().Unix()
+	if visibilityTimestamp > now {
+		return 0, ErrMessageInFlight
+	}
+
+	// Mirrors the ORDER BY priority DESC, sort_key IS NULL, sort_key ASC,
+	// created_at ASC, id ASC of Dequeue
+	countStmt := `
+		SELECT COUNT(*) FROM %s
+		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ?
+		AND (priority > ? OR (priority = ? AND (
+			sort_key < ? OR (? IS NULL AND sort_key IS NOT NULL)
+			OR (sort_key IS ? AND (created_at < ? OR (created_at = ? AND id < ?))))))
+	`
+	var key interface{}
+	if sortKey.Valid {
+		key = sortKey.Float64
+	}
+	var ahead int
+	err = q.QueryRow(fmt.Sprintf(countStmt, table), queueName, now, priority, priority, key, key, key, createdAt, createdAt, messageID).Scan(&ahead)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count messages ahead: %w", err)
+	}
+	return ahead + 1, nil
+}
+
+// ListMessages returns up to limit unprocessed messages of queueName, visible
+// or in flight, without leasing them. They are sorted by sortBy, one of the
+// keys of listSortColumns, in order "asc" or "desc", or in dequeue order if
+// sortBy is empty.
+func (mq *MessageQueue) ListMessages(queueName, sortBy, order string, limit int) ([]MessageInfo, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	result := []MessageInfo{}
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return result, nil
+	}
+
+	orderBy := "priority DESC, sort_key IS NULL, sort_key ASC, created_at ASC, id ASC"
+	if sortBy != "" {
+		column, ok := listSortColumns[sortBy]
+		if !ok {
+			return nil, fmt.Errorf("invalid sort column %q", sortBy)
+		}
+		direction := "DESC"
+		if order == "asc" {
+			direction = "ASC"
+		}
+		orderBy = column + " " + direction + ", id " + direction
+	}
+
+	stmt := `
+		SELECT id, message, encrypted, nonce, priority, created_at, receive_count, visibility_timestamp, blob_ref, key_id
+		FROM ` + table + `
+		WHERE queue_name = ? AND processed = 0
+		ORDER BY ` + orderBy + ` LIMIT ?
+	`
+	rows, err := mq.db.Query(stmt, queueName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now().Unix()
+	for rows.Next() {
+		var info MessageInfo
+		var message, nonce []byte
+		var encrypted bool
+		var createdAt, visibilityTimestamp int64
+		var blobRef, keyID sql.NullString
+		if err := rows.Scan(&info.MessageID, &message, &encrypted, &nonce, &info.Priority, &createdAt, &info.ReceiveCount, &visibilityTimestamp, &blobRef, &keyID); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		info.Message, err = mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+		if err != nil {
+			return nil, err
+		}
+		info.CreatedAt = time.Unix(0, createdAt)
+		info.InFlight = visibilityTimestamp > now
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// Peek returns up to limit messages of queueName in the order Dequeue would
+// hand them out, without leasing them: their visibility, delete token and
+// receive count are left as they are. Poison messages, which Dequeue would
+// drop or dead-letter rather than deliver, are skipped.
+func (mq *MessageQueue) Peek(queueName string, limit int) ([]PeekedMessage, error) {
+	result := []PeekedMessage{}
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return result, nil
+	}
+
+	db := mq.reader()
+
+	stmt := `
+		SELECT id, message, encrypted, nonce, priority, created_at, receive_count, blob_ref, key_id
+		FROM ` + table + `
+		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp <= ? AND receive_count < ?
+		ORDER BY priority DESC, sort_key IS NULL, sort_key ASC, created_at ASC, id ASC LIMIT ?
+	`
+	rows, err := db.Query(stmt, queueName, time.Now().Unix(), mq.maxReceives, limit)
+	if isMissingTable(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var peeked PeekedMessage
+		var message, nonce []byte
+		var encrypted bool
+		var createdAt int64
+		var blobRef, keyID sql.NullString
+		if err := rows.Scan(&peeked.MessageID, &message, &encrypted, &nonce, &peeked.Priority, &createdAt, &peeked.ReceiveCount, &blobRef, &keyID); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		peeked.Message, err = mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+		if err != nil {
+			return nil, err
+		}
+		peeked.CreatedAt = time.Unix(0, createdAt)
+		result = append(result, peeked)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+	return result, nil
+}
+
+// GetMessage returns the unprocessed message messageID of queueName, visible
+// or in flight, without leasing it. It returns ErrMessageNotFound if there
+// is no such message.
+func (mq *MessageQueue) GetMessage(queueName string, messageID int64) (MessageInfo, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return MessageInfo{}, ErrMessageNotFound
+	}
+
+	stmt := `
+		SELECT id, message, encrypted, nonce, priority, created_at, receive_count, visibility_timestamp, blob_ref, key_id
+		FROM ` + table + `
+		WHERE id = ? AND queue_name = ? AND processed = 0
+	`
+	var info MessageInfo
+	var message, nonce []byte
+	var encrypted bool
+	var createdAt, visibilityTimestamp int64
+	var blobRef, keyID sql.NullString
+	err := mq.db.QueryRow(stmt, messageID, queueName).Scan(&info.MessageID, &message, &encrypted, &nonce, &info.Priority, &createdAt, &info.ReceiveCount, &visibilityTimestamp, &blobRef, &keyID)
+	if err == sql.ErrNoRows {
+		return MessageInfo{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return MessageInfo{}, fmt.Errorf("failed to select message: %w", err)
+	}
+	info.Message, err = mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+	if err != nil {
+		return MessageInfo{}, err
+	}
+	info.CreatedAt = time.Unix(0, createdAt)
+	info.InFlight = visibilityTimestamp > time.Now().Unix()
+	return info, nil
+}
+
+// ExportMessages writes every message that hasn't been processed yet,
+// visible or in flight, to w as one JSON object per line, with its body
+// decrypted. Messages are written queue by queue in dequeue order. It
+// returns the number of messages written.
+func (mq *MessageQueue) ExportMessages(w io.Writer) (int, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	return mq.exportMessages(w)
+}
+
+// exportMessages is ExportMessages for callers already holding the lock.
+func (mq *MessageQueue) exportMessages(w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	now := time.Now().Unix()
+	count := 0
+	for _, table := range mq.messageTables() {
+		rows, err := mq.db.Query(`
+			SELECT id, queue_name, message, encrypted, nonce, priority, created_at, receive_count, visibility_timestamp, blob_ref, key_id
+			FROM ` + table + `
+			WHERE processed = 0
+			ORDER BY queue_name, priority DESC, sort_key IS NULL, sort_key ASC, created_at ASC, id ASC
+		`)
+		if isMissingTable(err) {
+			continue
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to select messages: %w", err)
+		}
+
+		for rows.Next() {
+			var exported ExportedMessage
+			var message, nonce []byte
+			var encrypted bool
+			var createdAt, visibilityTimestamp int64
+			var blobRef, keyID sql.NullString
+			err := rows.Scan(&exported.MessageID, &exported.QueueName, &message, &encrypted, &nonce, &exported.Priority, &createdAt, &exported.ReceiveCount, &visibilityTimestamp, &blobRef, &keyID)
+			if err != nil {
+				rows.Close()
+				return count, fmt.Errorf("failed to scan message: %w", err)
+			}
+			exported.Message, err = mq.loadMessage(message, nonce, encrypted, blobRef, keyID)
+			if err != nil {
+				rows.Close()
+				return count, err
+			}
+			exported.CreatedAt = time.Unix(0, createdAt)
+			exported.InFlight = visibilityTimestamp > now
+			if err := encoder.Encode(exported); err != nil {
+				rows.Close()
+				return count, fmt.Errorf("failed to write message: %w", err)
+			}
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return count, fmt.Errorf("failed to read messages: %w", err)
+		}
+	}
+	return count, nil
+}
+
+// EmptyReason explains why a dequeue of queueName with minAvailable found
+// nothing to hand out, as one of the EmptyReason constants.
+func (mq *MessageQueue) EmptyReason(queueName string, minAvailable int) (string, error) {
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return EmptyReasonEmpty, nil
+	}
+
+	db := mq.reader()
+
+	var visible, pending int
+	stmt := "SELECT COALESCE(SUM(CASE WHEN visibility_timestamp <= ? THEN 1 ELSE 0 END), 0), COUNT(*) FROM " + table + " WHERE queue_name = ? AND processed = 0"
+	err := db.QueryRow(stmt, time.Now().Unix(), queueName).Scan(&visible, &pending)
+	if isMissingTable(err) {
+		return EmptyReasonEmpty, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to count pending messages: %w", err)
+	}
+
+	switch {
+	case pending == 0:
+		return EmptyReasonEmpty, nil
+	case visible == 0:
+		return EmptyReasonAllDelayed, nil
+	case visible < minAvailable:
+		return EmptyReasonBelowMinAvailable, nil
+	}
+	// A message arrived after the dequeue gave up
+	return EmptyReasonEmpty, nil
+}
+
+// GetQueueLength returns how many visible messages queueName holds, plus
+// its retained processed messages if includeProcessed is set.
+func (mq *MessageQueue) GetQueueLength(queueName string, includeProcessed bool) (int, error) {
+	db := mq.reader()
+
+	return mq.getQueueLength(db, queueName, includeProcessed)
+}
+
+// GetDelayedCount returns how many messages of queueName were enqueued with
+// a delay that hasn't passed yet. Like messages in flight they are left out
+// of the queue length.
+func (mq *MessageQueue) GetDelayedCount(queueName string) (int, error) {
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, nil
+	}
+
+	db := mq.reader()
+
+	// Only messages that were never received can still be waiting out
+	// their delay; hidden ones that were are in flight or backing off
+	var count int
+	stmt := "SELECT COUNT(*) FROM " + table + " WHERE queue_name = ? AND processed = 0 AND receive_count = 0 AND visibility_timestamp > ?"
+	err := db.QueryRow(stmt, queueName, time.Now().Unix()).Scan(&count)
+	if isMissingTable(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to count delayed messages: %w", err)
+	}
+	return count, nil
+}
+
+// GetQueueDepth returns the visible and in-flight message counts of
+// queueName and the age of its oldest message in seconds, 0 if it is empty.
+func (mq *MessageQueue) GetQueueDepth(queueName string) (visible, inFlight int, oldestAgeSeconds int64, err error) {
+	table, ok := mq.messageTable(queueName)
+	if !ok {
+		return 0, 0, 0, nil
+	}
+
+	db := mq.reader()
+
+	now := time.Now()
+	stmt := `
+		SELECT COALESCE(SUM(CASE WHEN visibility_timestamp <= ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN visibility_timestamp > ? AND receive_count > 0 THEN 1 ELSE 0 END), 0),
+			MIN(created_at)
+		FROM ` + table + `
+		WHERE queue_name = ? AND processed = 0
+	`
+	var oldestCreatedAt sql.NullInt64
+	err = db.QueryRow(stmt, now.Unix(), now.Unix(), queueName).Scan(&visible, &inFlight, &oldestCreatedAt)
+	if err != nil && !isMissingTable(err) {
+		return 0, 0, 0, fmt.Errorf("failed to get queue depth: %w", err)
+	}
+	if oldestCreatedAt.Valid {
+		oldestAgeSeconds = (now.UnixNano() - oldestCreatedAt.Int64) / int64(time.Second)
+	}
+	return visible, inFlight, oldestAgeSeconds, nil
+}
+
+// GetStuckMessages returns the stuck messages of every queue that has
+// StuckAlertSeconds configured, by queue and message id.
+func (mq *MessageQueue) GetStuckMessages() ([]StuckMessage, error) {
+	db := mq.reader()
+
+	rows, err := db.Query("SELECT queue_name, config FROM queue_config ORDER BY queue_name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query queue configs: %w", err)
+	}
+	thresholds := make(map[string]int)
+	var queueNames []string
+	for rows.Next() {
+		var queueName, data string
+		if err := rows.Scan(&queueName, &data); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan queue config: %w", err)
+		}
+		var config QueueConfig
+		if err := json.Unmarshal([]byte(data), &config); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to decode queue config: %w", err)
+		}
+		if config.StuckAlertSeconds > 0 {
+			thresholds[queueName] = config.StuckAlertSeconds
+			queueNames = append(queueNames, queueName)
+		}
+	}
+	rows.Close()
+
+	now := time.Now().Unix()
+	stmt := `
+		SELECT id, priority, leased_at FROM %[1]s
+		WHERE queue_name = ? AND processed = 0 AND visibility_timestamp > ? AND leased_at <= ?
+			AND priority >= (SELECT MAX(priority) FROM %[1]s WHERE queue_name = ? AND processed = 0)
+		ORDER BY id
+	`
+	stuck := []StuckMessage{}
+	for _, queueName := range queueNames {
+		table, ok := mq.messageTable(queueName)
+		if !ok {
+			continue
+		}
+		rows, err := db.Query(fmt.Sprintf(stmt, table), queueName, now, now-int64(thresholds[queueName]), queueName)
+		if isMissingTable(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query stuck messages: %w", err)
+		}
+		for rows.Next() {
+			m := StuckMessage{QueueName: queueName}
+			var leasedAt int64
+			if err := rows.Scan(&m.MessageID, &m.Priority, &leasedAt); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan stuck message: %w", err)
+			}
+			m.InFlightSeconds = now - leasedAt
+			stuck = append(stuck, m)
+		}
+		rows.Close()
+	}
+	return stuck, nil
+}
+
+// GetUniqueQueueNames returns the queues holding visible messages, or
+// retained processed messages if includeProcessed is set, with their counts.
+func (mq *MessageQueue) GetUniqueQueueNames(includeProcessed bool) ([]UniqueQueueNamesResponse, error) {
+	db := mq.reader()
+
+	currentTime := time.Now().Unix()
+	stmt := `
+		SELECT queue_name, COUNT(*) AS count
+		FROM %s
+		WHERE ` + countFilter(includeProcessed) + `
+		GROUP BY queue_name
+	`
+
+	var result []UniqueQueueNamesResponse
+
+	for _, table := range mq.messageTables() {
+		rows, err := db.Query(fmt.Sprintf(stmt, table), currentTime)
+		if isMissingTable(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query unique queue names: %w", err)
+		}
+
+		for rows.Next() {
+			var queueName string
+			var count int
+			if err := rows.Scan(&queueName, &count); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan queue name and count: %w", err)
+			}
+			result = append(result, UniqueQueueNamesResponse{QueueName: queueName, Count: count})
+		}
+		rows.Close()
+	}
+
+	return result, nil
+}
+
+// GetAllQueues lists every queue that holds messages or has been configured,
+// whether or not any messages are currently visible, with its visible and
+// in-flight counts, the age of its oldest message and its configuration.
+func (mq *MessageQueue) GetAllQueues() ([]QueueInfo, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	now := time.Now()
+	stmt := `
+		SELECT queue_name,
+			SUM(CASE WHEN visibility_timestamp <= ? THEN 1 ELSE 0 END),
+			SUM(CASE WHEN visibility_timestamp > ? AND receive_count > 0 THEN 1 ELSE 0 END),
+			MIN(created_at)
+		FROM %s
+		WHERE processed = 0
+		GROUP BY queue_name
+	`
+
+	queues := make(map[string]*QueueInfo)
+	for _, table := range mq.messageTables() {
+		rows, err := mq.db.Query(fmt.Sprintf(stmt, table), now.Unix(), now.Unix())
+		if err != nil {
+			return nil, fmt.Errorf("failed to query queues: %w", err)
+		}
+
+		for rows.Next() {
+			var info QueueInfo
+			var oldestCreatedAt int64
+			if err := rows.Scan(&info.QueueName, &info.Visible, &info.InFlight, &oldestCreatedAt); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan queue: %w", err)
+			}
+			info.OldestAgeSeconds = (now.UnixNano() - oldestCreatedAt) / int64(time.Second)
+			queues[info.QueueName] = &info
+		}
+		rows.Close()
+	}
+
+	configRows, err := mq.db.Query("SELECT queue_name, config FROM queue_config")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query queue configs: %w", err)
+	}
+	defer configRows.Close()
+
+	for configRows.Next() {
+		var queueName, data string
+		if err := configRows.Scan(&queueName, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan queue config: %w", err)
+		}
+		config := &QueueConfig{}
+		if err := json.Unmarshal([]byte(data), config); err != nil {
+			return nil, fmt.Errorf("failed to decode queue config: %w", err)
+		}
+		info, ok := queues[queueName]
+		if !ok {
+			info = &QueueInfo{QueueName: queueName}
+			queues[queueName] = info
+		}
+		info.Config = config
+	}
+
+	result := make([]QueueInfo, 0, len(queues))
+	for _, info := range queues {
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].QueueName < result[j].QueueName })
+	return result, nil
+}
+
+func incrementStatsCounter(counter *int) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	*counter++
+}
+
+func incrementQueueStats(queueName string, update func(qs *QueueStats)) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	qs, ok := queueStats[queueName]
+	if !ok {
+		qs = &QueueStats{QueueName: queueName}
+		queueStats[queueName] = qs
+	}
+	update(qs)
+}
+
+// recordQueueRate adds enqueued and dequeued messages of queueName to the
+// counters behind /queue_rate.
+func recordQueueRate(queueName string, enqueued, dequeued int) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	qr, ok := queueRates[queueName]
+	if !ok {
+		qr = &queueRate{}
+		queueRates[queueName] = qr
+	}
+	now := time.Now().Unix()
+	qr.enqueues.add(now, enqueued)
+	qr.dequeues.add(now, dequeued)
+}
+
+// getQueueRate returns the enqueue and dequeue rates of queueName over the
+// last rateWindowSeconds.
+func getQueueRate(queueName string) QueueRateResponse {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	response := QueueRateResponse{QueueName: queueName, WindowSeconds: rateWindowSeconds}
+	qr, ok := queueRates[queueName]
+	if !ok {
+		return response
+	}
+	now := time.Now().Unix()
+	response.EnqueueRate = qr.enqueues.rate(now)
+	response.DequeueRate = qr.dequeues.rate(now)
+	response.NetRate = response.EnqueueRate - response.DequeueRate
+	return response
+}
+
+// drainQueueStats returns the counters for queueName and resets them to zero
+// under the same lock, so each call reports only what happened since the last.
+func drainQueueStats(queueName string) QueueStats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	qs, ok := queueStats[queueName]
+	if !ok {
+		return QueueStats{QueueName: queueName}
+	}
+	drained := *qs
+	delete(queueStats, queueName)
+	return drained
+}
+
+// trackConnections keeps stats.ActiveConnections in step with the server's
+// open client connections.
+func trackConnections(conn net.Conn, state http.ConnState) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	switch state {
+	case http.StateNew:
+		stats.ActiveConnections++
+	case http.StateClosed, http.StateHijacked:
+		stats.ActiveConnections--
+	}
+}
+
+// normalizeQueueName lowercases and trims queueName when queue names are
+// normalized, so that "Orders" and "orders " name the same queue.
+func normalizeQueueName(queueName string) string {
+	if !normalizeQueueNames {
+		return queueName
+	}
+	return strings.ToLower(strings.TrimSpace(queueName))
+}
+
+func enqueueHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.URL.Query().Get("queue_name"))
+		priorityStr := r.URL.Query().Get("priority")
+		if queueName == "" || priorityStr == "" {
+			http.Error(w, "Missing queue_name or priority parameter", http.StatusBadRequest)
+			return
+		}
+
+		priority, err := strconv.Atoi(priorityStr)
+		if err != nil {
+			http.Error(w, "Invalid priority parameter", http.StatusBadRequest)
+			return
+		}
+
+		receiptURL := r.URL.Query().Get("receipt_url")
+		if err := validate.Var(receiptURL, "omitempty,http_url,max=2048"); err != nil {
+			http.Error(w, "Invalid receipt_url parameter", http.StatusBadRequest)
+			return
+		}
+		if receiptURL != "" && !callbackHostAllowed(receiptURL) {
+			http.Error(w, "receipt_url host is not allowed by --callback-hosts", http.StatusBadRequest)
+			return
+		}
+
+		dedupID := r.URL.Query().Get("dedup_id")
+		if err := validate.Var(dedupID, "max=256"); err != nil {
+			http.Error(w, "Invalid dedup_id parameter", http.StatusBadRequest)
+			return
+		}
+
+		delaySeconds := 0
+		if delayStr := r.URL.Query().Get("delay_seconds"); delayStr != "" {
+			delaySeconds, err = strconv.Atoi(delayStr)
+			if err != nil || delaySeconds < 0 || delaySeconds > maxVisibilityTimeout {
+				http.Error(w, fmt.Sprintf("Invalid delay_seconds parameter, must be between 0 and %d", maxVisibilityTimeout), http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := int64(mq.messageSizeLimit())
+		if r.ContentLength > limit {
+			writeBodyTooLarge(w, r.ContentLength, limit)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeBodyTooLarge(w, 0, limit)
+				return
+			}
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		if len(body) > mq.maxMessageSize {
-			http.Error(w, fmt.Sprintf("Message size exceeds maximum limit of %d bytes", mq.maxMessageSize), http.StatusRequestEntityTooLarge)
+		// Catches producers that meant to send text but sent raw binary
+		if requireUTF8 && r.URL.Query().Get("binary") != "true" && !utf8.Valid(body) {
+			http.Error(w, "Message body is not valid UTF-8; set binary=true to enqueue binary data as it is", http.StatusBadRequest)
+			return
+		}
+
+		withPosition := r.URL.Query().Get("position") == "true"
+		result, err := mq.Enqueue(queueName, body, priority, receiptURL, dedupID, delaySeconds, withPosition)
+		if err != nil {
+			if err == ErrLoadShed {
+				http.Error(w, fmt.Sprintf("Queue %s is over its high-water mark and is rejecting low priority messages", queueName), http.StatusServiceUnavailable)
+				return
+			}
+			if err == ErrDatabaseFull {
+				http.Error(w, "The database is full and no messages can be evicted to make room", http.StatusInsufficientStorage)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		incrementQueueStats(queueName, func(qs *QueueStats) { qs.EnqueueCount++ })
+		if !result.Collapsed {
+			recordQueueRate(queueName, 1, 0)
+		}
+		if enqueueAccepted {
+			w.Header().Set("Location", messageLocation(queueName, result.MessageID))
+			w.WriteHeader(http.StatusAccepted)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func enqueueFanoutHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req FanoutRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		for i, queueName := range req.QueueNames {
+			req.QueueNames[i] = normalizeQueueName(queueName)
+		}
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Message) > mq.maxMessageSize {
+			writeBodyTooLarge(w, int64(len(req.Message)), int64(mq.maxMessageSize))
+			return
+		}
+
+		results, err := mq.EnqueueFanout(req.QueueNames, req.Message, int(req.Priority))
+		if err == ErrDatabaseFull {
+			http.Error(w, "The database is full and no messages can be evicted to make room", http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, result := range results {
+			if result.EnqueueResult == nil {
+				continue
+			}
+			incrementQueueStats(result.QueueName, func(qs *QueueStats) { qs.EnqueueCount++ })
+			if !result.Collapsed {
+				recordQueueRate(result.QueueName, 1, 0)
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	}
+}
+
+func enqueueBatchHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req EnqueueBatchRequest
+		if !decodeJSONBody(w, r, &req, maxEnqueueBatchBody) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, item := range req.Messages {
+			if len(item.Message) > mq.maxMessageSize {
+				writeBodyTooLarge(w, int64(len(item.Message)), int64(mq.maxMessageSize))
+				return
+			}
+		}
+
+		results, err := mq.EnqueueBatch(req.QueueName, req.Messages)
+		if err != nil {
+			var fullErr *QueueFullError
+			switch {
+			case errors.As(err, &fullErr):
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(QueueFullResponse{Error: err.Error(), Available: fullErr.Available})
+			case err == ErrLoadShed:
+				http.Error(w, fmt.Sprintf("Queue %s is over its high-water mark and is rejecting low priority messages", req.QueueName), http.StatusServiceUnavailable)
+			case err == ErrDatabaseFull:
+				http.Error(w, "The database is full and no messages can be evicted to make room", http.StatusInsufficientStorage)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		stored := 0
+		for _, result := range results {
+			if !result.Collapsed {
+				stored++
+			}
+		}
+		incrementQueueStats(req.QueueName, func(qs *QueueStats) { qs.EnqueueCount += len(results) })
+		recordQueueRate(req.QueueName, stored, 0)
+
+		json.NewEncoder(w).Encode(EnqueueBatchResponse{QueueName: req.QueueName, Results: results})
+	}
+}
+
+// longPollLimiter caps how many dequeue requests may long-poll the same
+// queue at once, so idle consumers can't turn an empty queue into a storm of
+// database polls.
+type longPollLimiter struct {
+	lock   sync.Mutex
+	active map[string]int
+	max    int // 0 means no limit
+}
+
+func newLongPollLimiter(max int) *longPollLimiter {
+	return &longPollLimiter{active: make(map[string]int), max: max}
+}
+
+func (l *longPollLimiter) acquire(queueName string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.max > 0 && l.active[queueName] >= l.max {
+		return false
+	}
+	l.active[queueName]++
+	return true
+}
+
+func (l *longPollLimiter) release(queueName string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.active[queueName]--
+	if l.active[queueName] <= 0 {
+		delete(l.active, queueName)
+	}
+}
+
+// writeDequeueError responds to a failed dequeue, telling consumers to back
+// off when the server's in-flight limit has been reached.
+// BodyTooLargeResponse is the JSON body of a 413 response, telling the client
+// how big its request was and how big it is allowed to be.
+type BodyTooLargeResponse struct {
+	Error string `json:"error"`
+	Size  int64  `json:"size,omitempty"`
+	Limit int64  `json:"limit"`
+}
+
+// requestBodyLimit is the largest JSON request body accepted. It leaves room
+// for a maximum-size message encoded as base64 plus the surrounding fields.
+func (mq *MessageQueue) requestBodyLimit() int64 {
+	return int64(mq.maxMessageSize)*4/3 + requestBodyOverhead
+}
+
+// writeBodyTooLarge responds 413 with the actual size, when known, and the limit.
+func writeBodyTooLarge(w http.ResponseWriter, size, limit int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(BodyTooLargeResponse{
+		Error: fmt.Sprintf("request body exceeds maximum limit of %d bytes", limit),
+		Size:  size,
+		Limit: limit,
+	})
+}
+
+// decodeJSONBody decodes the request body into dst, reading at most limit
+// bytes. On failure it writes the error response and returns false: 413 for
+// an oversized body, and 400 for an empty or malformed one, or with
+// --strict-json one holding a field dst doesn't have.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}, limit int64) bool {
+	if r.ContentLength > limit {
+		writeBodyTooLarge(w, r.ContentLength, limit)
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	if strictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(dst)
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	var priorityErr *PriorityError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		// The body was streamed without a Content-Length, so its full size is unknown.
+		writeBodyTooLarge(w, 0, limit)
+	case err == io.EOF:
+		http.Error(w, "Empty request body", http.StatusBadRequest)
+	case errors.As(err, &priorityErr):
+		http.Error(w, priorityErr.Error(), http.StatusBadRequest)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		http.Error(w, "Unknown field "+strings.TrimPrefix(err.Error(), "json: unknown field ")+" in request body", http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+	}
+	return false
+}
+
+func writeDequeueError(w http.ResponseWriter, err error) {
+	if err == ErrInFlightLimit {
+		w.Header().Set("Retry-After", strconv.Itoa(inFlightRetryAfter))
+		w.Header().Set("X-Empty-Reason", EmptyReasonThrottled)
+		http.Error(w, fmt.Sprintf("Too many messages are in flight, retry after %d seconds", inFlightRetryAfter), http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func dequeueHandler(mq *MessageQueue, longPolls *longPollLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DequeueRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.WithQueueStats && req.ConsumerGroup != "" {
+			http.Error(w, "with_queue_stats is not supported together with consumer_group", http.StatusBadRequest)
+			return
+		}
+
+		if req.LeaseOwner != "" && req.ConsumerGroup != "" {
+			http.Error(w, "lease_owner is not supported together with consumer_group", http.StatusBadRequest)
+			return
+		}
+
+		if req.MaxMessages > 1 && req.ConsumerGroup != "" {
+			http.Error(w, "max_messages is not supported together with consumer_group", http.StatusBadRequest)
+			return
+		}
+
+		databasePollInterval := req.DatabasePollInterval
+		if databasePollInterval == 0 {
+			databasePollInterval = 1
+		}
+
+		var messages []*DequeuedMessage
+		respond := func() {
+			incrementQueueStats(req.QueueName, func(qs *QueueStats) { qs.DequeueCount += len(messages) })
+			recordQueueRate(req.QueueName, 0, len(messages))
+			// Single-message dequeues keep their original response shape
+			if req.MaxMessages <= 1 {
+				json.NewEncoder(w).Encode(messages[0].response(req.Verbose))
+				return
+			}
+			response := make([]interface{}, 0, len(messages))
+			for _, message := range messages {
+				response = append(response, message.response(req.Verbose))
+			}
+			json.NewEncoder(w).Encode(response)
+		}
+
+		attempt := func() (bool, error) {
+			// Batch consumers only want to wake up once enough work has piled up
+			if req.MinAvailable > 1 {
+				count, err := mq.GetQueueLength(req.QueueName, false)
+				if err != nil {
+					return false, err
+				}
+				if count < req.MinAvailable {
+					return false, nil
+				}
+			}
+
+			var err error
+			if req.ConsumerGroup != "" {
+				var message *DequeuedMessage
+				message, err = mq.DequeueGroup(req.QueueName, req.ConsumerGroup, req.VisibilityTimeout)
+				if message != nil {
+					messages = []*DequeuedMessage{message}
+				}
+			} else {
+				messages, err = mq.DequeueMany(req.QueueName, req.VisibilityTimeout, databasePollInterval, max(req.MaxMessages, 1), req.WithQueueStats, req.LeaseOwner, req.ProcessingLabel)
+			}
+			return len(messages) > 0, err
+		}
+
+		// Serve straight away if a message is waiting; only an empty queue
+		// turns the request into a long poll that counts against the limit.
+		served, err := attempt()
+		if err != nil {
+			writeDequeueError(w, err)
+			return
+		}
+		if served {
+			respond()
+			return
+		}
+
+		if !longPolls.acquire(req.QueueName) {
+			w.Header().Set("Retry-After", strconv.Itoa(longPollRetryAfter))
+			http.Error(w, fmt.Sprintf("Too many consumers are long-polling queue %s, retry after %d seconds", req.QueueName, longPollRetryAfter), http.StatusTooManyRequests)
+			return
+		}
+		defer longPolls.release(req.QueueName)
+
+		ctx, cancel := context.WithTimeout(r.Context(), longPollTimeout)
+		defer cancel()
+
+		// Each consumer group and threshold gets its own poller, since a
+		// message one group has already consumed may still be new to
+		// another, and a depth too low for one waiter may do for the next
+		pollerKey := req.QueueName
+		if req.ConsumerGroup != "" {
+			pollerKey += "/" + req.ConsumerGroup
+		}
+		if req.MinAvailable > 1 {
+			pollerKey += fmt.Sprintf("?min_available=%d", req.MinAvailable)
+		}
+
+		interval := time.Duration(databasePollInterval) * time.Second
+		served, err = mq.WaitForMessage(ctx, pollerKey, interval, attempt)
+		if err != nil {
+			writeDequeueError(w, err)
+			return
+		}
+		if !served {
+			// Consumer groups track their progress per group, so the
+			// queue's messages don't tell why this group got nothing
+			if req.ConsumerGroup == "" {
+				reason, err := mq.EmptyReason(req.QueueName, req.MinAvailable)
+				if err != nil {
+					log.Printf("Failed to determine why dequeue of queue %s came back empty: %v", req.QueueName, err)
+				} else {
+					w.Header().Set("X-Empty-Reason", reason)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		respond()
+	}
+}
+
+func dequeueByIDHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DequeueByIDRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		message, err := mq.DequeueByID(req.QueueName, req.ID, req.VisibilityTimeout, req.LeaseOwner, req.ProcessingLabel)
+		if err == ErrMessageNotFound {
+			http.Error(w, fmt.Sprintf("Message %d not found in queue %s", req.ID, req.QueueName), http.StatusNotFound)
+			return
+		}
+		if err == ErrMessageInFlight {
+			http.Error(w, fmt.Sprintf("Message %d is in flight", req.ID), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			writeDequeueError(w, err)
+			return
+		}
+
+		incrementQueueStats(req.QueueName, func(qs *QueueStats) { qs.DequeueCount++ })
+		recordQueueRate(req.QueueName, 0, 1)
+		json.NewEncoder(w).Encode(message.response(req.Verbose))
+	}
+}
+
+func claimAllHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ClaimAllRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MaxAgeSeconds > 0 && req.MaxAgeSeconds < req.MinAgeSeconds {
+			http.Error(w, "max_age_seconds cannot be less than min_age_seconds", http.StatusBadRequest)
+			return
+		}
+
+		messages, err := mq.ClaimAll(req.QueueName, req.VisibilityTimeout, req.MinAgeSeconds, req.MaxAgeSeconds, req.Limit, req.LeaseOwner, req.ProcessingLabel)
+		if err != nil {
+			writeDequeueError(w, err)
+			return
+		}
+
+		if len(messages) > 0 {
+			incrementQueueStats(req.QueueName, func(qs *QueueStats) { qs.DequeueCount += len(messages) })
+			recordQueueRate(req.QueueName, 0, len(messages))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(messages)
+	}
+}
+
+func deleteHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DeleteRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		success, err := mq.DeleteMessage(req.DeleteToken)
+		if err != nil {
+			switch err {
+			case ErrInvalidDeleteToken:
+				http.Error(w, "Invalid delete token", http.StatusBadRequest)
+			case ErrDeleteTokenExpired:
+				http.Error(w, "Delete token has expired", http.StatusGone)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if !success {
+			http.Error(w, "Delete failed", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func releaseHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReleaseRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		released, err := mq.ReleaseMessage(req.DeleteToken)
+		if err != nil {
+			switch err {
+			case ErrInvalidDeleteToken:
+				http.Error(w, "Invalid delete token", http.StatusBadRequest)
+			case ErrDeleteTokenExpired:
+				http.Error(w, "Delete token has expired", http.StatusGone)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if !released {
+			http.Error(w, "No message is leased under this delete token", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func rerouteHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RerouteRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.DestQueue = normalizeQueueName(req.DestQueue)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		messageID, err := mq.Reroute(req.DeleteToken, req.DestQueue)
+		if err != nil {
+			switch err {
+			case ErrMessageNotFound:
+				http.Error(w, "No message is leased under this delete token", http.StatusNotFound)
+			case ErrSameQueue:
+				http.Error(w, fmt.Sprintf("Message is already in queue %s", req.DestQueue), http.StatusBadRequest)
+			case ErrInvalidDeleteToken:
+				http.Error(w, "Invalid delete token", http.StatusBadRequest)
+			case ErrDeleteTokenExpired:
+				http.Error(w, "Delete token has expired", http.StatusGone)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(RerouteResponse{QueueName: req.DestQueue, MessageID: messageID})
+	}
+}
+
+func failHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req FailRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var newPriority *int
+		if req.NewPriority != nil {
+			p := int(*req.NewPriority)
+			newPriority = &p
+		}
+
+		response, err := mq.Fail(req.DeleteToken, req.Permanent, newPriority)
+		if err != nil {
+			switch err {
+			case ErrMessageNotFound:
+				http.Error(w, "No message is leased under this delete token", http.StatusNotFound)
+			case ErrNoDeadLetterQueue:
+				http.Error(w, "The message's queue has no dead_letter_queue configured", http.StatusBadRequest)
+			case ErrInvalidDeleteToken:
+				http.Error(w, "Invalid delete token", http.StatusBadRequest)
+			case ErrDeleteTokenExpired:
+				http.Error(w, "Delete token has expired", http.StatusGone)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func heartbeatHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req HeartbeatRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.TimeoutSeconds == 0 {
+			req.TimeoutSeconds = defaultHeartbeatTimeout
+		}
+
+		response, err := mq.Heartbeat(req.DeleteToken, req.TimeoutSeconds)
+		if err != nil {
+			switch err {
+			case ErrMessageNotFound:
+				http.Error(w, "No message is leased under this delete token", http.StatusNotFound)
+			case ErrLeaseExpired:
+				http.Error(w, "Lease has expired, the message may have been redelivered", http.StatusGone)
+			case ErrLeaseCapReached:
+				http.Error(w, "Message has been in flight for the queue's max_lease_seconds and will be redelivered", http.StatusConflict)
+			case ErrInvalidDeleteToken:
+				http.Error(w, "Invalid delete token", http.StatusBadRequest)
+			case ErrDeleteTokenExpired:
+				http.Error(w, "Delete token has expired", http.StatusGone)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func extendVisibilityHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ExtendVisibilityRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response, err := mq.ChangeVisibility(req.DeleteToken, req.VisibilityTimeout)
+		if err != nil {
+			switch err {
+			case ErrMessageNotFound:
+				http.Error(w, "No message is leased under this delete token", http.StatusNotFound)
+			case ErrLeaseCapReached:
+				http.Error(w, "Message has been in flight for the queue's max_lease_seconds and will be redelivered", http.StatusConflict)
+			case ErrInvalidDeleteToken:
+				http.Error(w, "Invalid delete token", http.StatusBadRequest)
+			case ErrDeleteTokenExpired:
+				http.Error(w, "Delete token has expired", http.StatusGone)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func setLabelHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SetLabelRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response, err := mq.SetLabel(req.DeleteToken, req.Label)
+		if err != nil {
+			switch err {
+			case ErrMessageNotFound:
+				http.Error(w, "No message is leased under this delete token", http.StatusNotFound)
+			case ErrLeaseExpired:
+				http.Error(w, "Lease has expired, the message may have been redelivered", http.StatusGone)
+			case ErrInvalidDeleteToken:
+				http.Error(w, "Invalid delete token", http.StatusBadRequest)
+			case ErrDeleteTokenExpired:
+				http.Error(w, "Delete token has expired", http.StatusGone)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func deleteAllHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DeleteAllRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.DryRun {
+			counts, err := mq.CountAllMessages(req.QueueName)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			response := DeleteAllDryRunResponse{Queues: counts}
+			for _, count := range counts {
+				response.Total += count.Count
+			}
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		err := mq.DeleteAllMessages(req.QueueName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func reprioritizeHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReprioritizeRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var fromPriority *int
+		if req.FromPriority != nil {
+			p := int(*req.FromPriority)
+			fromPriority = &p
+		}
+
+		updated, err := mq.Reprioritize(req.QueueName, req.MessageIDs, fromPriority, int(req.Priority))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := ReprioritizeResponse{QueueName: req.QueueName, Updated: updated}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func replayHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ReplayRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.To.IsZero() {
+			req.To = time.Now()
+		}
+		if req.To.Before(req.From) {
+			http.Error(w, "to must not be before from", http.StatusBadRequest)
+			return
+		}
+
+		replayed, err := mq.Replay(req.QueueName, req.From, req.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := ReplayResponse{QueueName: req.QueueName, Replayed: replayed}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func recoverStuckHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queueName := normalizeQueueName(query.Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		stuckForSeconds, err := strconv.Atoi(query.Get("stuck_for_seconds"))
+		if err != nil || stuckForSeconds < 0 {
+			http.Error(w, "Missing or invalid stuck_for_seconds parameter", http.StatusBadRequest)
+			return
+		}
+
+		action := query.Get("action")
+		if action == "" {
+			action = RecoverCount
+		}
+		if action != RecoverCount && action != RecoverReset && action != RecoverDeadLetter {
+			http.Error(w, "Invalid action parameter, must be one of count, reset, dead_letter", http.StatusBadRequest)
+			return
+		}
+
+		affected, err := mq.RecoverStuck(queueName, time.Duration(stuckForSeconds)*time.Second, action)
+		if err != nil {
+			if err == ErrNoDeadLetterQueue {
+				http.Error(w, fmt.Sprintf("Queue %s has no dead_letter_queue configured", queueName), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := RecoverStuckResponse{QueueName: queueName, Action: action, Affected: affected}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func purgePoisonHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queueName := normalizeQueueName(query.Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		minReceiveCount, err := strconv.Atoi(query.Get("min_receive_count"))
+		if err != nil || minReceiveCount < 1 {
+			http.Error(w, "Missing or invalid min_receive_count parameter", http.StatusBadRequest)
+			return
+		}
+
+		action := query.Get("action")
+		if action == "" {
+			action = PurgeDelete
+		}
+		if action != PurgeDelete && action != PurgeDeadLetter {
+			http.Error(w, "Invalid action parameter, must be one of delete, dead_letter", http.StatusBadRequest)
+			return
+		}
+
+		affected, err := mq.PurgePoison(queueName, minReceiveCount, action)
+		if err != nil {
+			if err == ErrNoDeadLetterQueue {
+				http.Error(w, fmt.Sprintf("Queue %s has no dead_letter_queue configured", queueName), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := PurgePoisonResponse{QueueName: queueName, MinReceiveCount: minReceiveCount, Action: action, Affected: affected}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func removeConsumerGroupHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RemoveConsumerGroupRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		removed, err := mq.RemoveConsumerGroup(req.QueueName, req.ConsumerGroup)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !removed {
+			http.Error(w, "Consumer group not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func getQueueLengthHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req QueueLengthRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		count, err := mq.GetQueueLength(req.QueueName, req.IncludeProcessed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		delayed, err := mq.GetDelayedCount(req.QueueName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		incrementStatsCounter(&stats.GetQueueLengthCount)
+		response := QueueLengthResponse{QueueName: req.QueueName, Count: count, Delayed: delayed}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func waitEmptyHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queueName := normalizeQueueName(query.Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		timeout := longPollTimeout
+		if timeoutStr := query.Get("timeout"); timeoutStr != "" {
+			seconds, err := strconv.Atoi(timeoutStr)
+			if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxWaitEmptyTimeout {
+				http.Error(w, fmt.Sprintf("Invalid timeout parameter, must be between 1 and %d seconds", int(maxWaitEmptyTimeout/time.Second)), http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		empty, err := mq.WaitEmpty(ctx, queueName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !empty {
+			http.Error(w, fmt.Sprintf("Queue %s did not drain within %s", queueName, timeout), http.StatusRequestTimeout)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func getUniqueQueueNamesHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueNames, err := mq.GetUniqueQueueNames(r.URL.Query().Get("include_processed") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		incrementStatsCounter(&stats.GetUniqueQueueNamesCount)
+		json.NewEncoder(w).Encode(queueNames)
+	}
+}
+
+// messageLocation is the URL of the message resource served by
+// getMessageHandler.
+func messageLocation(queueName string, messageID int64) string {
+	return fmt.Sprintf("/queues/%s/messages/%d", queueName, messageID)
+}
+
+func getMessageHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.PathValue("name"))
+		if err := validate.Var(queueName, "queue_name"); err != nil {
+			http.Error(w, "Invalid queue name", http.StatusBadRequest)
+			return
+		}
+
+		messageID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || messageID < 1 {
+			http.Error(w, "Invalid message id", http.StatusBadRequest)
+			return
+		}
+
+		info, err := mq.GetMessage(queueName, messageID)
+		if err != nil {
+			if err == ErrMessageNotFound {
+				http.Error(w, "Message not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+func listMessagesHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queueName := normalizeQueueName(query.Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		sortBy := query.Get("sort_by")
+		if _, ok := listSortColumns[sortBy]; sortBy != "" && !ok {
+			http.Error(w, "Invalid sort_by parameter, must be one of created_at, priority, receive_count", http.StatusBadRequest)
+			return
+		}
+
+		order := query.Get("order")
+		if order != "" && order != "asc" && order != "desc" {
+			http.Error(w, "Invalid order parameter, must be asc or desc", http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultListLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			var err error
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > maxListLimit {
+				http.Error(w, fmt.Sprintf("Invalid limit parameter, must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		messages, err := mq.ListMessages(queueName, sortBy, order, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(messages)
+	}
+}
+
+func peekHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req PeekRequest
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
+			return
+		}
+
+		req.QueueName = normalizeQueueName(req.QueueName)
+
+		if err := validate.Struct(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Limit == 0 {
+			req.Limit = 1
+		}
+
+		messages, err := mq.Peek(req.QueueName, req.Limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(messages)
+	}
+}
+
+func inFlightHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queueName := normalizeQueueName(query.Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultListLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			var err error
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 || limit > maxListLimit {
+				http.Error(w, fmt.Sprintf("Invalid limit parameter, must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		messages, err := mq.GetInFlight(queueName, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(messages)
+	}
+}
+
+func activeConsumersHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.URL.Query().Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		response, err := mq.ActiveConsumers(queueName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func getLeasesHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leaseOwner := r.URL.Query().Get("lease_owner")
+		if err := validate.Var(leaseOwner, "required,max=255"); err != nil {
+			http.Error(w, "Missing or invalid lease_owner parameter", http.StatusBadRequest)
+			return
+		}
+
+		leases, err := mq.GetLeases(leaseOwner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(leases)
+	}
+}
+
+// headQueueLengthHandler reports the length of the queue named in the query
+// string in the X-Queue-Length header, for pollers that don't need a body.
+func headQueueLengthHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.URL.Query().Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		count, err := mq.GetQueueLength(queueName, r.URL.Query().Get("include_processed") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		incrementStatsCounter(&stats.GetQueueLengthCount)
+		w.Header().Set("X-Queue-Length", strconv.Itoa(count))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// headUniqueQueueNamesHandler reports how many queues have visible messages
+// in the X-Queue-Count header.
+func headUniqueQueueNamesHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueNames, err := mq.GetUniqueQueueNames(r.URL.Query().Get("include_processed") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		incrementStatsCounter(&stats.GetUniqueQueueNamesCount)
+		w.Header().Set("X-Queue-Count", strconv.Itoa(len(queueNames)))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func getAllQueuesHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queues, err := mq.GetAllQueues()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(queues)
+	}
+}
+
+// validateQueueConfig normalizes config and checks that it is a valid
+// configuration for queueName.
+func validateQueueConfig(mq *MessageQueue, queueName string, config *QueueConfig) error {
+	config.DeadLetterQueue = normalizeQueueName(config.DeadLetterQueue)
+
+	if err := validate.Struct(config); err != nil {
+		return err
+	}
+
+	if config.DeadLetterQueue == queueName {
+		return errors.New("a queue cannot be its own dead_letter_queue")
+	}
+	if config.PushURL != "" && !callbackHostAllowed(config.PushURL) {
+		return errors.New("push_url host is not allowed by --callback-hosts")
+	}
+	if config.EncryptionKeyID != "" {
+		if _, err := mq.cipherFor(config.EncryptionKeyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getQueueConfigHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.PathValue("name"))
+		if err := validate.Var(queueName, "queue_name"); err != nil {
+			http.Error(w, "Invalid queue name", http.StatusBadRequest)
+			return
+		}
+
+		config, err := mq.GetQueueConfig(queueName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(config)
+	}
+}
+
+func setQueueConfigHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.PathValue("name"))
+		if err := validate.Var(queueName, "queue_name"); err != nil {
+			http.Error(w, "Invalid queue name", http.StatusBadRequest)
+			return
+		}
+
+		var config QueueConfig
+		if !decodeJSONBody(w, r, &config, mq.requestBodyLimit()) {
+			return
+		}
+
+		if err := validateQueueConfig(mq, queueName, &config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if err := mq.Enqueue(queueName, body, priority); err != nil {
+		if err := mq.SetQueueConfig(queueName, config); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// Start or stop push delivery right away rather than on the next sync
+		mq.syncPushSubscriptions()
 
-		incrementStatsCounter(&stats.EnqueueCount)
-		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(config)
 	}
 }
 
-func dequeueHandler(mq *MessageQueue) http.HandlerFunc {
+func exportConfigHandler(mq *MessageQueue) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req DequeueRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		configs, err := mq.ExportQueueConfigs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ConfigExport{Queues: configs})
+	}
+}
+
+func importConfigHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		overwrite := r.URL.Query().Get("overwrite") == "true"
+
+		var req ConfigExport
+		if !decodeJSONBody(w, r, &req, mq.requestBodyLimit()) {
 			return
 		}
 
@@ -445,160 +7538,817 @@ func dequeueHandler(mq *MessageQueue) http.HandlerFunc {
 			return
 		}
 
-		databasePollInterval := req.DatabasePollInterval
-		if databasePollInterval == 0 {
-			databasePollInterval = 1
+		// Everything is validated up front so a bad entry can't leave the
+		// import half applied
+		configs := make(map[string]QueueConfig, len(req.Queues))
+		for queueName, config := range req.Queues {
+			normalized := normalizeQueueName(queueName)
+			if err := validate.Var(normalized, "queue_name"); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid queue name %q", queueName), http.StatusBadRequest)
+				return
+			}
+			if err := validateQueueConfig(mq, normalized, &config); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid config for queue %s: %v", normalized, err), http.StatusBadRequest)
+				return
+			}
+			if _, ok := configs[normalized]; ok {
+				http.Error(w, fmt.Sprintf("Queue %s is listed more than once", normalized), http.StatusBadRequest)
+				return
+			}
+			configs[normalized] = config
+		}
+
+		response, err := mq.ImportQueueConfigs(configs, overwrite)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		timeout := time.After(30 * time.Second)
-		ticker := time.NewTicker(time.Duration(databasePollInterval) * time.Second)
-		defer ticker.Stop()
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func eventsHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queueName := normalizeQueueName(query.Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		var types map[string]bool
+		if typesStr := query.Get("types"); typesStr != "" {
+			types = make(map[string]bool)
+			for _, eventType := range strings.Split(typesStr, ",") {
+				switch eventType {
+				case EventEnqueued, EventDequeued, EventDeleted, EventDeadLettered:
+					types[eventType] = true
+				default:
+					http.Error(w, fmt.Sprintf("Invalid event type %q, must be one of enqueued, dequeued, deleted, dead_lettered", eventType), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		// The stream stays open for as long as the client listens, so it is
+		// exempt from the server's write timeout
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("failed to clear write deadline for %s: %v", r.URL.Path, err)
+		}
+
+		subscriber := mq.events.subscribe(queueName, types)
+		defer mq.events.unsubscribe(subscriber)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
 
+		keepalive := time.NewTicker(eventKeepaliveInterval)
+		defer keepalive.Stop()
 		for {
 			select {
-			case <-timeout:
-				w.WriteHeader(http.StatusNoContent)
+			case <-r.Context().Done():
 				return
-			case <-ticker.C:
-				message, deleteToken, err := mq.Dequeue(req.QueueName, req.VisibilityTimeout, databasePollInterval)
+			case event := <-subscriber.events:
+				data, err := json.Marshal(event)
 				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					log.Printf("failed to encode queue event: %v", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
 					return
 				}
-
-				if message != nil {
-					incrementStatsCounter(&stats.DequeueCount)
-					response := map[string]interface{}{"message": message, "delete_token": deleteToken}
-					json.NewEncoder(w).Encode(response)
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
 					return
 				}
 			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func queueRateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.URL.Query().Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(getQueueRate(queueName))
+	}
+}
+
+// intQueryParam parses the integer query parameter name, returning def if
+// the parameter is absent. It reports false if the parameter isn't an integer.
+func intQueryParam(query url.Values, name string, def int) (int, bool) {
+	value := query.Get(name)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil
+}
+
+func scalingHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queueName := normalizeQueueName(query.Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		var targets ScalingTargets
+		for _, param := range []struct {
+			name  string
+			value *int
+			def   int
+		}{
+			{"target_per_consumer", &targets.TargetPerConsumer, defaultTargetPerConsumer},
+			{"target_age_seconds", &targets.TargetAgeSeconds, 0},
+			{"min_consumers", &targets.MinConsumers, 0},
+			{"max_consumers", &targets.MaxConsumers, 0},
+		} {
+			var ok bool
+			if *param.value, ok = intQueryParam(query, param.name, param.def); !ok {
+				http.Error(w, fmt.Sprintf("Invalid %s parameter", param.name), http.StatusBadRequest)
+				return
+			}
+		}
+		if rate := query.Get("rate_per_consumer"); rate != "" {
+			var err error
+			if targets.RatePerConsumer, err = strconv.ParseFloat(rate, 64); err != nil {
+				http.Error(w, "Invalid rate_per_consumer parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := validate.Struct(targets); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if targets.MaxConsumers > 0 && targets.MaxConsumers < targets.MinConsumers {
+			http.Error(w, "max_consumers cannot be less than min_consumers", http.StatusBadRequest)
+			return
+		}
+
+		response := ScalingResponse{QueueName: queueName, Targets: targets}
+		var err error
+		response.Visible, response.InFlight, response.OldestAgeSeconds, err = mq.GetQueueDepth(queueName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rate := getQueueRate(queueName)
+		response.EnqueueRate, response.DequeueRate = rate.EnqueueRate, rate.DequeueRate
+		response.AgeExceeded = targets.TargetAgeSeconds > 0 && response.OldestAgeSeconds > int64(targets.TargetAgeSeconds)
+		response.DesiredConsumers = response.desiredConsumers()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func positionHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.URL.Query().Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		messageID, err := strconv.ParseInt(r.URL.Query().Get("message_id"), 10, 64)
+		if err != nil || messageID < 1 {
+			http.Error(w, "Missing or invalid message_id parameter", http.StatusBadRequest)
+			return
+		}
+
+		position, err := mq.GetPosition(queueName, messageID)
+		if err != nil {
+			switch err {
+			case ErrMessageNotFound:
+				http.Error(w, "Message not found", http.StatusNotFound)
+			case ErrMessageInFlight:
+				http.Error(w, "Message is in flight", http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		response := PositionResponse{QueueName: queueName, MessageID: messageID, Position: position}
+		response.DequeueRate = getQueueRate(queueName).DequeueRate
+		if response.DequeueRate > 0 {
+			wait := float64(position) / response.DequeueRate
+			response.EstimatedWaitSeconds = &wait
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// collectStats gathers the figures of /stats. The in-memory counters are
+// copied under statsLock, so the report never mixes values from before and
+// after an update.
+func collectStats(mq *MessageQueue) (StatsReport, error) {
+	// The totals are summed from the per-queue counters, so the two
+	// views always agree
+	totals, err := mq.GetTotalCounters()
+	if err != nil {
+		return StatsReport{}, err
+	}
+
+	inFlight, err := mq.GetInFlightCount()
+	if err != nil {
+		return StatsReport{}, err
+	}
+
+	stuck, err := mq.GetStuckMessages()
+	if err != nil {
+		return StatsReport{}, err
+	}
+	if stuck == nil {
+		stuck = []StuckMessage{}
+	}
+
+	statsLock.Lock()
+	snapshot := stats
+	statsLock.Unlock()
+
+	return StatsReport{Stats: snapshot, QueueCounters: totals, InFlight: inFlight, MaxInFlight: mq.maxInFlight, Stuck: stuck, Push: mq.GetPushStatuses(), Hibernating: mq.GetHibernatingQueues()}, nil
+}
+
+func statsHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := collectStats(mq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl := `
+		<html>
+		<head><title>Stats</title></head>
+		<body>
+		<h1>Stats</h1>
+		<ul>
+			<li>Enqueue Count: {{.EnqueueCount}}</li>
+			<li>Dequeue Count: {{.DequeueCount}}</li>
+			<li>Delete Count: {{.DeleteCount}}</li>
+			<li>Poison Drop Count: {{.PoisonDropCount}}</li>
+			<li>Permanent Failure Count: {{.PermanentFailureCount}}</li>
+			<li>Get Queue Length Count: {{.GetQueueLengthCount}}</li>
+			<li>Get Unique Queue Names Count: {{.GetUniqueQueueNamesCount}}</li>
+			<li>Active Connections: {{.ActiveConnections}}</li>
+			<li>In-Flight Messages: {{.InFlight}}{{if .MaxInFlight}} of {{.MaxInFlight}}{{end}}</li>
+			<li>Last Cleanup At: {{if .LastCleanupAt.IsZero}}never{{else}}{{.LastCleanupAt.Format "2006-01-02 15:04:05 MST"}}{{end}}</li>
+			<li>Last Cleanup Rows Deleted: {{.LastCleanupRowsDeleted}}</li>
+			<li>Last Cleanup Duration (ms): {{.LastCleanupDurationMs}}</li>
+			<li>Cleanup Runs Skipped: {{.CleanupSkippedCount}}</li>
+			<li>Messages Evicted for Space: {{.EvictedCount}}</li>
+		</ul>
+		{{if .Stuck}}
+		<h2>Stuck High-Priority Messages</h2>
+		<ul>
+			{{range .Stuck}}<li>Queue {{.QueueName}}: message {{.MessageID}} with priority {{.Priority}}, in flight for {{.InFlightSeconds}} seconds</li>
+			{{end}}
+		</ul>
+		{{end}}
+		{{if .Hibernating}}
+		<h2>Hibernating Queues</h2>
+		<p>Idle queues skipped by cleanup: {{range $i, $q := .Hibernating}}{{if $i}}, {{end}}{{$q}}{{end}}</p>
+		{{end}}
+		{{if .Push}}
+		<h2>Push Subscriptions</h2>
+		<ul>
+			{{range .Push}}<li>Queue {{.QueueName}} to {{.PushURL}} ({{.Concurrency}} workers): {{.Delivered}} delivered, {{.Failed}} failed{{if .LastError}}, last error at {{.LastFailedAt.Format "2006-01-02 15:04:05 MST"}}: {{.LastError}}{{end}}</li>
+			{{end}}
+		</ul>
+		{{end}}
+		</body>
+		</html>
+		`
+
+		t, err := template.New("stats").Parse(tmpl)
+		if err != nil {
+			http.Error(w, "Failed to generate stats page", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		if err := t.Execute(w, report); err != nil {
+			http.Error(w, "Failed to render stats page", http.StatusInternalServerError)
+		}
+	}
+}
+
+func statsJSONHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := collectStats(mq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// metricsHandler serves the stats in the Prometheus text exposition format.
+// The counters are the persisted per-queue ones, so they don't reset when
+// the server restarts.
+func metricsHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		counters, err := mq.GetAllQueueCounters()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lengths, err := mq.GetUniqueQueueNames(false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inFlight, err := mq.GetInFlightCount()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		statsLock.Lock()
+		snapshot := stats
+		statsLock.Unlock()
+
+		var b strings.Builder
+		queueCounter := func(name, help string, value func(QueueCounters) int) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+			for _, c := range counters {
+				fmt.Fprintf(&b, "%s{queue=%q} %d\n", name, c.QueueName, value(c))
+			}
+		}
+		queueCounter("sasquatch_enqueue_total", "Messages enqueued.", func(c QueueCounters) int { return c.EnqueueCount })
+		queueCounter("sasquatch_dequeue_total", "Messages dequeued.", func(c QueueCounters) int { return c.DequeueCount })
+		queueCounter("sasquatch_delete_total", "Messages deleted by consumers.", func(c QueueCounters) int { return c.DeleteCount })
+		queueCounter("sasquatch_poison_drop_total", "Poison messages dropped or dead-lettered.", func(c QueueCounters) int { return c.PoisonDropCount })
+		queueCounter("sasquatch_permanent_failure_total", "Messages dead-lettered through /fail.", func(c QueueCounters) int { return c.PermanentFailureCount })
+
+		b.WriteString("# HELP sasquatch_queue_length Visible messages in the queue.\n# TYPE sasquatch_queue_length gauge\n")
+		for _, q := range lengths {
+			fmt.Fprintf(&b, "sasquatch_queue_length{queue=%q} %d\n", q.QueueName, q.Count)
+		}
+
+		fmt.Fprintf(&b, "# HELP sasquatch_in_flight_messages Messages leased out across all queues.\n# TYPE sasquatch_in_flight_messages gauge\nsasquatch_in_flight_messages %d\n", inFlight)
+		fmt.Fprintf(&b, "# HELP sasquatch_active_connections Open client connections.\n# TYPE sasquatch_active_connections gauge\nsasquatch_active_connections %d\n", snapshot.ActiveConnections)
+		fmt.Fprintf(&b, "# HELP sasquatch_cleanup_skipped_total Cleanup runs skipped because the queue was busy.\n# TYPE sasquatch_cleanup_skipped_total counter\nsasquatch_cleanup_skipped_total %d\n", snapshot.CleanupSkippedCount)
+		fmt.Fprintf(&b, "# HELP sasquatch_evicted_total Messages evicted to keep the database under --max-db-bytes.\n# TYPE sasquatch_evicted_total counter\nsasquatch_evicted_total %d\n", snapshot.EvictedCount)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		io.WriteString(w, b.String())
+	}
+}
+
+func queueStatsHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queueName := normalizeQueueName(r.URL.Query().Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
+		}
+
+		counters, err := mq.GetQueueCounters(queueName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(counters)
+	}
+}
+
+func flushHandler(mq *MessageQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Checkpoint the latest stats counters too, so a backup has them
+		if err := mq.FlushStats(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response, err := mq.Flush()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func drainStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		queueName := normalizeQueueName(r.URL.Query().Get("queue_name"))
+		if err := validate.Var(queueName, "required,queue_name"); err != nil {
+			http.Error(w, "Missing or invalid queue_name parameter", http.StatusBadRequest)
+			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drainQueueStats(queueName))
+	}
+}
+
+// gzipResponseWriter compresses everything written to it. The gzip stream is
+// only started on the first write, so responses without a body, such as 204s
+// and HEAD responses, stay empty.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(statusCode int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.gz == nil {
+		w.Header().Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) close() error {
+	if w.gz == nil {
+		return nil
 	}
+	return w.gz.Close()
 }
 
-func deleteHandler(mq *MessageQueue) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req DeleteRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+// withReadOnly rejects requests that would write to the database of a server
+// started with --read-only. Reads use GET and HEAD, except for the POST form
+// of /queue_length and /peek.
+func withReadOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.URL.Path != "/queue_length" && r.URL.Path != "/peek" {
+			http.Error(w, "Server is running read-only", http.StatusServiceUnavailable)
 			return
 		}
+		handler.ServeHTTP(w, r)
+	})
+}
 
-		if err := validate.Struct(req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+// drainPaths are the endpoints that take on new work, which a draining
+// server refuses.
+var drainPaths = map[string]bool{
+	"/enqueue":        true,
+	"/enqueue_fanout": true,
+	"/enqueue_batch":  true,
+	"/dequeue":        true,
+	"/dequeue_by_id":  true,
+	"/claim_all":      true,
+}
+
+// withDrain rejects requests that would take on new work once draining is
+// set, while consumers can still delete, fail or heartbeat the messages
+// they hold.
+func withDrain(handler http.Handler, draining *atomic.Bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() && drainPaths[r.URL.Path] {
+			http.Error(w, "Server is draining", http.StatusServiceUnavailable)
 			return
 		}
+		handler.ServeHTTP(w, r)
+	})
+}
 
-		success, err := mq.DeleteMessage(req.DeleteToken)
+// drainToFile stops the server taking on new work, waits up to timeout for
+// the messages in flight to be acknowledged and then writes every message
+// left, including any still in flight, to path as NDJSON. The file is
+// written next to path and renamed into place once complete, so a file at
+// path is always a full export. The queue lock is held from the export
+// until the server is closed, so no message is leased out after it was
+// exported.
+func drainToFile(mq *MessageQueue, server *http.Server, draining *atomic.Bool, path string, timeout time.Duration) error {
+	draining.Store(true)
+	log.Printf("Draining, waiting up to %s for in-flight messages", timeout)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight, err := mq.inFlightCount(mq.reader())
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
-
-		if !success {
-			http.Error(w, "Delete failed", http.StatusNotFound)
-			return
+		if inFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("%d messages still in flight after %s, exporting them as well", inFlight, timeout)
+			break
 		}
+		time.Sleep(waitEmptyCheckInterval)
+	}
 
-		incrementStatsCounter(&stats.DeleteCount)
-		w.WriteHeader(http.StatusOK)
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create drain file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	// Long polls that started before draining may still be waiting
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+
+	count, err := mq.exportMessages(f)
+	if err == nil {
+		err = f.Sync()
 	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write drain file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to write drain file: %w", err)
+	}
+	log.Printf("Drained %d messages to %s", count, path)
+	return server.Close()
 }
 
-func deleteAllHandler(mq *MessageQueue) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req DeleteAllRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
+// shutdown stops server from taking new connections and waits up to
+// shutdownTimeout for the requests in progress, closing the connections of
+// any that are left after that.
+func shutdown(server *http.Server) {
+	log.Printf("Shutting down, waiting up to %s for requests to finish", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-		if err := validate.Struct(req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Requests still running after %s, closing their connections: %v", shutdownTimeout, err)
+		server.Close()
+	}
+}
+
+// withCompression decompresses request bodies sent with Content-Encoding
+// gzip and compresses responses for clients that accept gzip.
+func withCompression(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			body, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body = io.NopCloser(body)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
 		}
 
-		err := mq.DeleteAllMessages(req.QueueName)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			handler.ServeHTTP(w, r)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer func() {
+			if err := gw.close(); err != nil {
+				log.Printf("failed to finish gzip response for %s: %v", r.URL.Path, err)
+			}
+		}()
+		handler.ServeHTTP(gw, r)
+	})
+}
+
+// accessLogWriter records the status and the number of body bytes of a
+// response for the access log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
 	}
+	w.ResponseWriter.WriteHeader(statusCode)
 }
 
-func getQueueLengthHandler(mq *MessageQueue) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req QueueLengthRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so /events
+// can still flush.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAccessLog writes a line to logger for every request once its response
+// is complete, so long polls are logged with their final status and their
+// whole duration. format is one of AccessLogJSON, AccessLogCLF and
+// AccessLogCombined.
+func withAccessLog(handler http.Handler, logger *log.Logger, format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+		handler.ServeHTTP(aw, r)
+		if aw.status == 0 {
+			aw.status = http.StatusOK
 		}
 
-		if err := validate.Struct(req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		remoteAddr := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			remoteAddr = host
+		}
+		if format == AccessLogJSON {
+			var line bytes.Buffer
+			encoder := json.NewEncoder(&line)
+			encoder.SetEscapeHTML(false) // Keep the & of query strings readable
+			err := encoder.Encode(AccessLogEntry{
+				Time:       start.UTC(),
+				RemoteAddr: remoteAddr,
+				Method:     r.Method,
+				Path:       r.URL.RequestURI(),
+				Status:     aw.status,
+				Bytes:      aw.bytes,
+				DurationMs: time.Since(start).Milliseconds(),
+			})
+			if err == nil {
+				logger.Print(line.String())
+			}
 			return
 		}
 
-		count, err := mq.GetQueueLength(req.QueueName)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		size := "-"
+		if aw.bytes > 0 {
+			size = strconv.FormatInt(aw.bytes, 10)
+		}
+		line := fmt.Sprintf("%s - - [%s] %s %d %s", remoteAddr, start.Format("02/Jan/2006:15:04:05 -0700"), strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto), aw.status, size)
+		if format == AccessLogCombined {
+			referer, userAgent := r.Referer(), r.UserAgent()
+			if referer == "" {
+				referer = "-"
+			}
+			if userAgent == "" {
+				userAgent = "-"
+			}
+			line += " " + strconv.Quote(referer) + " " + strconv.Quote(userAgent)
 		}
+		logger.Println(line)
+	})
+}
 
-		incrementStatsCounter(&stats.GetQueueLengthCount)
-		response := QueueLengthResponse{QueueName: req.QueueName, Count: count}
-		json.NewEncoder(w).Encode(response)
+// acceptsGzip reports whether the client sent gzip in Accept-Encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(encoding), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
 	}
+	return false
 }
 
-func getUniqueQueueNamesHandler(mq *MessageQueue) http.HandlerFunc {
+// withWriteDeadline lets handler run for up to maxDuration on top of the
+// server's write timeout. Routes that legitimately hold a request open, like
+// long polls, are wrapped in it so a tight server-wide write timeout only
+// applies to short request/response endpoints.
+func withWriteDeadline(handler http.HandlerFunc, writeTimeout, maxDuration time.Duration) http.HandlerFunc {
+	if writeTimeout <= 0 {
+		return handler
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		queueNames, err := mq.GetUniqueQueueNames()
+		err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(maxDuration + writeTimeout))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			log.Printf("failed to extend write deadline for %s: %v", r.URL.Path, err)
 		}
-
-		incrementStatsCounter(&stats.GetUniqueQueueNamesCount)
-		json.NewEncoder(w).Encode(queueNames)
+		handler(w, r)
 	}
 }
 
-func statsHandler() http.HandlerFunc {
+func configHandler(config ServerConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		statsLock.Lock()
-		defer statsLock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+	}
+}
 
-		tmpl := `
-		<html>
-		<head><title>Stats</title></head>
-		<body>
-		<h1>Stats</h1>
-		<ul>
-			<li>Enqueue Count: {{.EnqueueCount}}</li>
-			<li>Dequeue Count: {{.DequeueCount}}</li>
-			<li>Delete Count: {{.DeleteCount}}</li>
-			<li>Get Queue Length Count: {{.GetQueueLengthCount}}</li>
-			<li>Get Unique Queue Names Count: {{.GetUniqueQueueNamesCount}}</li>
-		</ul>
-		</body>
-		</html>
-		`
+// benchmarkQueue is the queue --benchmark works on.
+const benchmarkQueue = "benchmark"
 
-		t, err := template.New("stats").Parse(tmpl)
-		if err != nil {
-			http.Error(w, "Failed to generate stats page", http.StatusInternalServerError)
-			return
-		}
+// runBenchmark has concurrency workers enqueue, dequeue and delete messages
+// of messageSize bytes on mq for duration, calling the MessageQueue methods
+// directly, and prints the throughput and latency percentiles of each
+// operation.
+func runBenchmark(mq *MessageQueue, concurrency int, duration time.Duration, messageSize int) error {
+	message := make([]byte, messageSize)
+	if _, err := rand.Read(message); err != nil {
+		return fmt.Errorf("failed to generate benchmark message: %w", err)
+	}
 
-		w.Header().Set("Content-Type", "text/html")
-		if err := t.Execute(w, stats); err != nil {
-			http.Error(w, "Failed to render stats page", http.StatusInternalServerError)
+	operations := []string{"enqueue", "dequeue", "delete"}
+	latencies := make([][3][]time.Duration, concurrency)
+	errs := make(chan error, concurrency)
+
+	log.Printf("Benchmarking with %d workers for %v, %d byte messages", concurrency, duration, messageSize)
+	start := time.Now()
+	deadline := start.Add(duration)
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				if _, err := mq.Enqueue(benchmarkQueue, message, 0, "", "", 0, false); err != nil {
+					errs <- err
+					return
+				}
+				latencies[worker][0] = append(latencies[worker][0], time.Since(t))
+
+				t = time.Now()
+				dequeued, err := mq.Dequeue(benchmarkQueue, 0, 0, false, "", "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if dequeued == nil {
+					// Another worker took the message
+					continue
+				}
+				latencies[worker][1] = append(latencies[worker][1], time.Since(t))
+
+				t = time.Now()
+				if _, err := mq.DeleteMessage(dequeued.DeleteToken); err != nil {
+					errs <- err
+					return
+				}
+				latencies[worker][2] = append(latencies[worker][2], time.Since(t))
+			}
+		}(worker)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return fmt.Errorf("benchmark failed: %w", err)
+	}
+
+	fmt.Printf("%-8s %10s %10s %10s %10s %10s %10s\n", "", "ops", "ops/s", "p50", "p90", "p99", "max")
+	for i, operation := range operations {
+		var all []time.Duration
+		for worker := range latencies {
+			all = append(all, latencies[worker][i]...)
 		}
+		sort.Slice(all, func(a, b int) bool { return all[a] < all[b] })
+		fmt.Printf("%-8s %10d %10.0f %10v %10v %10v %10v\n", operation, len(all), float64(len(all))/elapsed.Seconds(),
+			percentile(all, 50), percentile(all, 90), percentile(all, 99), percentile(all, 100))
+	}
+	return nil
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
 	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
 }
 
 func printHelp() {
@@ -611,15 +8361,94 @@ func printHelp() {
 	fmt.Println("  --memory            Use in-memory database")
 	fmt.Println("  --max-queue-length  Specify the maximum queue length (default: 5000)")
 	fmt.Println("  --max-message-size  Specify the maximum message size in kilobytes (default: 256, max: 10240)")
+	fmt.Println("  --max-long-polls-per-queue  Specify the maximum number of concurrent long-polling dequeues per queue (default: 0, no limit)")
+	fmt.Println("  --max-connections   Specify the maximum number of simultaneous client connections (default: 0, no limit)")
+	fmt.Println("  --max-in-flight     Specify the maximum number of messages leased out at once across all queues (default: 0, no limit)")
+	fmt.Println("  --sqlite-params     Extra SQLite driver parameters appended to the database DSN, such as _journal_mode=WAL&_busy_timeout=5000")
+	fmt.Println("  --read-connections  Number of read-only database connections serving length and stats queries without the queue lock (default: 0, disabled)")
+	fmt.Println("  --encryption-key    Hex-encoded AES-128/192/256 key used to encrypt message bodies at rest")
+	fmt.Println("  --keyring           JSON file mapping key ids to hex-encoded AES keys, selected per queue by encryption_key_id")
+	fmt.Println("  --token-secret      Hex-encoded key used to sign delete tokens, so forged and expired tokens are rejected")
+	fmt.Println("  --token-format      Format of the ids in delete tokens: uuidv4, uuidv7 or ulid (default: uuidv4)")
+	fmt.Println("  --table-per-queue   Store each queue's messages in its own table")
+	fmt.Println("  --cleanup-lock-timeout  Milliseconds cleanup waits for a busy queue lock before skipping the run (default: 500)")
+	fmt.Println("  --cleanup-interval  Seconds between runs of the cleanup task (default: 60)")
+	fmt.Println("  --hibernate-after   Seconds without enqueues, dequeues or deletes after which cleanup skips a queue; 0 to never skip (default: 0)")
+	fmt.Println("  --queue-length-cache  Seconds a queue's visible message count is cached for length checks; 0 to always count (default: 0)")
+	fmt.Println("  --max-db-bytes      Size in bytes the database may grow to before the lowest-priority, oldest messages are evicted, not counting the WAL and blob-dir files; 0 for no limit (default: 0)")
+	fmt.Println("  --max-receives      Receives without a delete after which a message is treated as poison (default: 4)")
+	fmt.Println("  --default-visibility-timeout  Visibility timeout in seconds of dequeues that don't ask for one (default: 30)")
+	fmt.Println("  --poison-action     What to do with poison messages: drop, or dead-letter to the queue's dead_letter_queue (default: drop)")
+	fmt.Println("  --blob-dir          Directory storing message bodies over --max-message-size, which are then accepted by /enqueue")
+	fmt.Println("  --max-blob-size     Specify the maximum size in megabytes of a message stored in --blob-dir (default: 100)")
+	fmt.Println("  --tls-cert          Path to a PEM certificate to serve HTTPS with (requires --tls-key)")
+	fmt.Println("  --tls-key           Path to the PEM private key of --tls-cert")
+	fmt.Println("  --tls-client-ca     Path to a PEM CA bundle; require client certificates signed by it (mutual TLS)")
+	fmt.Println("  --normalize-queue-names  Lowercase and trim queue names in all operations")
+	fmt.Println("  --strict-json       Reject JSON request bodies containing fields the endpoint doesn't know")
+	fmt.Println("  --require-utf8      Reject /enqueue bodies that aren't valid UTF-8 unless the request sets binary=true")
+	fmt.Println("  --enqueue-accepted  Answer /enqueue with 202 Accepted and a Location header for the new message")
+	fmt.Println("  --access-log-format  Format of the access log written to stdout: json, clf (Common Log Format) or combined (default: json)")
+	fmt.Println("  --read-only         Open the database read-only, serving only requests that don't write to it")
+	fmt.Println("  --recover-in-flight  Make messages that were in flight when the server stopped visible again at startup")
+	fmt.Println("  --callback-hosts    Comma-separated hosts that receipt_url and push_url may point to; both are refused unless given")
+	fmt.Println("  --callback-allow-private  Let receipts and pushes go to loopback, private and link-local addresses")
+	fmt.Println("  --disable-endpoints  Comma-separated endpoints not to serve, such as delete_all,dequeue; they answer 404")
+	fmt.Println("  --drain-to-file     On SIGINT or SIGTERM, stop taking work, wait for in-flight messages and export the rest to this NDJSON file")
+	fmt.Println("  --drain-timeout     Seconds --drain-to-file waits for in-flight messages to be acknowledged (default: 60)")
+	fmt.Println("  --write-timeout     Seconds a response may take to write; long-poll endpoints get their wait on top (default: 0, no limit)")
+	fmt.Println("  --benchmark         Run a load test on a scratch database instead of serving, then exit")
+	fmt.Println("  --benchmark-concurrency  Number of benchmark workers (default: 8)")
+	fmt.Println("  --benchmark-duration  Seconds the benchmark runs (default: 10)")
+	fmt.Println("  --benchmark-message-size  Size of the benchmark messages in bytes (default: 1024)")
 	fmt.Println()
 	fmt.Println("Endpoints:")
 	fmt.Println("  POST /enqueue             Enqueue a message")
+	fmt.Println("  POST /enqueue_fanout      Enqueue a copy of a message into several queues at once")
+	fmt.Println("  POST /enqueue_batch       Enqueue up to 1000 messages into a queue in one transaction")
 	fmt.Println("  POST /dequeue             Dequeue a message with optional database poll interval")
+	fmt.Println("  POST /dequeue_by_id       Lease a specific message by id")
+	fmt.Println("  POST /claim_all           Lease every visible message of a queue matching an age filter, up to a limit")
 	fmt.Println("  POST /delete              Delete a message using delete token")
+	fmt.Println("  POST /release             Hand an in-flight message back to its queue right away using its delete token")
+	fmt.Println("  POST /reroute             Move an in-flight message to another queue using its delete token")
+	fmt.Println("  POST /fail                Report a failed message, to dead-letter it if permanent or retry it after backoff")
+	fmt.Println("  POST /heartbeat           Extend the lease of an in-flight message while its consumer works on it")
+	fmt.Println("  POST /extend_visibility   Hide an in-flight message for longer, unless it has been redelivered")
+	fmt.Println("  POST /set_label           Set the processing label of an in-flight message using its delete token")
 	fmt.Println("  POST /delete_all          Delete all messages in a specified queue or all messages in the database")
+	fmt.Println("  POST /reprioritize        Change the priority of visible messages in a queue")
+	fmt.Println("  POST /replay              Make retained processed messages of a queue visible again")
+	fmt.Println("  POST /recover_stuck       Count, reset or dead-letter messages whose lease expired long ago without redelivery")
+	fmt.Println("  POST /purge_poison        Delete or dead-letter visible messages that were received at least a given number of times")
+	fmt.Println("  POST /remove_consumer_group  Unregister a consumer group from a queue")
 	fmt.Println("  POST /queue_length        Get the length of a specific queue")
+	fmt.Println("  HEAD /queue_length        Get the length of a queue in the X-Queue-Length header")
+	fmt.Println("  GET  /wait_empty          Wait until a queue has no visible or in-flight messages")
+	fmt.Println("  GET  /events              Stream the enqueue, dequeue, delete and dead-letter events of a queue (SSE)")
 	fmt.Println("  GET  /queues              Get unique queue names and their counts")
+	fmt.Println("  HEAD /queues              Get the number of queues in the X-Queue-Count header")
+	fmt.Println("  GET  /queues/all          List every queue holding messages or configured, with counts, oldest age and config")
+	fmt.Println("  GET  /messages            List the messages of a queue without leasing them, optionally sorted")
+	fmt.Println("  POST /peek                Show the next messages a dequeue would return, without leasing them")
+	fmt.Println("  GET  /queues/{name}/messages/{id}  Get a single message of a queue without leasing it")
+	fmt.Println("  GET  /inflight            List the in-flight messages of a queue with their lease details and processing labels")
+	fmt.Println("  GET  /active_consumers    Count the distinct lease owners holding in-flight messages of a queue")
+	fmt.Println("  GET  /my_leases           List the in-flight messages and delete tokens held by a lease owner")
+	fmt.Println("  GET  /position            Get the place of a message in dequeue order and its estimated wait")
+	fmt.Println("  GET  /scaling             Get the depth, oldest age and rates of a queue with a recommended number of consumers")
+	fmt.Println("  GET  /queues/{name}/config  Get the configuration of a queue")
+	fmt.Println("  PUT  /queues/{name}/config  Replace the configuration of a queue")
+	fmt.Println("  GET  /export_config       Export the configuration of every queue")
+	fmt.Println("  POST /import_config       Import queue configurations, reporting conflicts with existing ones")
 	fmt.Println("  GET  /stats               Display statistics about the requests")
+	fmt.Println("  GET  /stats.json          The statistics of /stats as JSON, for scripts and monitoring")
+	fmt.Println("  GET  /metrics             The statistics and queue lengths in the Prometheus text format")
+	fmt.Println("  POST /stats/drain         Return and reset the counters for a specific queue")
+	fmt.Println("  GET  /queue_stats         Get the persisted enqueue, dequeue, delete and poison drop counts of a queue")
+	fmt.Println("  GET  /queue_rate          Get the recent enqueue, dequeue and net rates of a queue")
+	fmt.Println("  GET  /config              Display the effective server configuration, with secrets redacted")
+	fmt.Println("  POST /admin/flush         Checkpoint the write-ahead log into the database file")
 }
 
 func main() {
@@ -630,6 +8459,46 @@ func main() {
 	memory := flag.Bool("memory", false, "Use in-memory database")
 	maxQueueLength := flag.Int("max-queue-length", 5000, "Specify the maximum queue length")
 	maxMessageSizeKB := flag.Int("max-message-size", 256, "Specify the maximum message size in kilobytes (max: 10240)")
+	maxLongPollsPerQueue := flag.Int("max-long-polls-per-queue", 0, "Specify the maximum number of concurrent long-polling dequeues per queue (0 for no limit)")
+	maxConnections := flag.Int("max-connections", 0, "Specify the maximum number of simultaneous client connections (0 for no limit)")
+	maxInFlight := flag.Int("max-in-flight", 0, "Specify the maximum number of messages leased out at once across all queues (0 for no limit)")
+	readConnections := flag.Int("read-connections", 0, "Specify the number of read-only database connections serving length and stats queries without the queue lock (0 to disable)")
+	encryptionKeyHex := flag.String("encryption-key", "", "Hex-encoded AES key (32, 48 or 64 hex digits) used to encrypt message bodies at rest")
+	keyringPath := flag.String("keyring", "", "JSON file mapping key ids to hex-encoded AES keys, selected per queue by encryption_key_id")
+	tokenSecretHex := flag.String("token-secret", "", "Hex-encoded key (at least 32 hex digits) used to sign delete tokens")
+	tokenFormat := flag.String("token-format", TokenUUIDv4, "Format of the ids in delete tokens: uuidv4, uuidv7 or ulid")
+	tablePerQueue := flag.Bool("table-per-queue", false, "Store each queue's messages in its own table")
+	cleanupLockTimeoutMs := flag.Int("cleanup-lock-timeout", 500, "Specify how many milliseconds cleanup waits for a busy queue lock before skipping the run")
+	cleanupIntervalSeconds := flag.Int("cleanup-interval", int(defaultCleanupInterval/time.Second), "Specify how many seconds pass between runs of the cleanup task")
+	hibernateAfterSeconds := flag.Int("hibernate-after", 0, "Specify after how many idle seconds cleanup skips a queue, 0 to never skip")
+	lengthCacheSeconds := flag.Int("queue-length-cache", 0, "Specify for how many seconds queue lengths are cached, 0 to always count them")
+	maxDBBytes := flag.Int64("max-db-bytes", 0, "Specify the size in bytes the database may grow to before messages are evicted, 0 for no limit")
+	maxReceivesFlag := flag.Int("max-receives", defaultMaxReceives, "Specify how many times a message is received without being deleted before it is treated as poison")
+	visibilityTimeoutSeconds := flag.Int("default-visibility-timeout", defaultVisibilityTimeout, "Specify the visibility timeout in seconds of dequeues that don't ask for one")
+	poisonAction := flag.String("poison-action", PoisonDrop, "What to do with poison messages: drop, or dead-letter to the queue's dead_letter_queue")
+	blobDir := flag.String("blob-dir", "", "Directory storing message bodies over max-message-size, which are then accepted by /enqueue")
+	maxBlobSizeMB := flag.Int("max-blob-size", defaultMaxBlobSize, "Specify the maximum size in megabytes of a message stored in blob-dir")
+	tlsCert := flag.String("tls-cert", "", "Path to a PEM certificate to serve HTTPS with (requires --tls-key)")
+	tlsKey := flag.String("tls-key", "", "Path to the PEM private key of --tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "Path to a PEM CA bundle; clients must present a certificate signed by it (requires --tls-cert)")
+	normalizeNames := flag.Bool("normalize-queue-names", false, "Lowercase and trim queue names in all operations")
+	accessLogFormat := flag.String("access-log-format", AccessLogJSON, "Format of the access log written to stdout: json, clf or combined")
+	strictJSONFlag := flag.Bool("strict-json", false, "Reject JSON request bodies containing fields the endpoint doesn't know")
+	requireUTF8Flag := flag.Bool("require-utf8", false, "Reject /enqueue bodies that aren't valid UTF-8 unless the request sets binary=true")
+	enqueueAcceptedFlag := flag.Bool("enqueue-accepted", false, "Answer /enqueue with 202 Accepted and a Location header for the new message")
+	sqliteParams := flag.String("sqlite-params", "", "Specify extra SQLite driver parameters to append to the database DSN, as a query string such as _journal_mode=WAL&_busy_timeout=5000")
+	readOnly := flag.Bool("read-only", false, "Open the database read-only and reject requests that would write to it")
+	recoverInFlight := flag.Bool("recover-in-flight", false, "Make messages that were in flight when the server stopped visible again at startup")
+	callbackHostsFlag := flag.String("callback-hosts", "", "Comma-separated hosts that receipt_url and push_url may point to; both are refused unless given")
+	callbackAllowPrivateFlag := flag.Bool("callback-allow-private", false, "Let receipts and pushes go to loopback, private and link-local addresses")
+	disableEndpoints := flag.String("disable-endpoints", "", "Comma-separated endpoints not to serve, named by their path without the leading slash, such as delete_all,dequeue")
+	drainToFilePath := flag.String("drain-to-file", "", "On SIGINT or SIGTERM, stop taking work, wait for in-flight messages and export the rest to this NDJSON file")
+	drainTimeoutSeconds := flag.Int("drain-timeout", defaultDrainTimeout, "Specify how many seconds --drain-to-file waits for in-flight messages to be acknowledged")
+	writeTimeoutSeconds := flag.Int("write-timeout", 0, "Specify how many seconds a response may take to write, on top of the wait of long-poll endpoints (0 for no limit)")
+	benchmark := flag.Bool("benchmark", false, "Run a load test on a scratch database instead of serving, then exit")
+	benchmarkConcurrency := flag.Int("benchmark-concurrency", 8, "Specify the number of benchmark workers")
+	benchmarkSeconds := flag.Int("benchmark-duration", 10, "Specify how many seconds the benchmark runs")
+	benchmarkMessageSize := flag.Int("benchmark-message-size", 1024, "Specify the size of the benchmark messages in bytes")
 
 	flag.Parse()
 
@@ -647,6 +8516,110 @@ func main() {
 		log.Fatalf("max-message-size cannot exceed 10240 KB (10 MB)")
 	}
 
+	if *maxLongPollsPerQueue < 0 {
+		log.Fatalf("max-long-polls-per-queue cannot be negative")
+	}
+
+	if *maxConnections < 0 {
+		log.Fatalf("max-connections cannot be negative")
+	}
+
+	if *maxInFlight < 0 {
+		log.Fatalf("max-in-flight cannot be negative")
+	}
+
+	if *readConnections < 0 {
+		log.Fatalf("read-connections cannot be negative")
+	}
+
+	if *readOnly && *memory {
+		log.Fatalf("read-only cannot be used with memory, since an in-memory database starts out empty")
+	}
+
+	if *readOnly && *recoverInFlight {
+		log.Fatalf("read-only cannot be used with recover-in-flight, since recovering messages writes to the database")
+	}
+
+	if *readOnly && *benchmark {
+		log.Fatalf("read-only cannot be used with benchmark")
+	}
+
+	if *readConnections > 0 && *memory {
+		log.Fatalf("read-connections cannot be used with memory, since other connections can't see an in-memory database")
+	}
+
+	sqliteParamsValue, err := parseSQLiteParams(*sqliteParams)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *cleanupLockTimeoutMs < 0 {
+		log.Fatalf("cleanup-lock-timeout cannot be negative")
+	}
+
+	if *cleanupIntervalSeconds < 1 {
+		log.Fatalf("cleanup-interval must be at least 1 second")
+	}
+	if *hibernateAfterSeconds < 0 {
+		log.Fatalf("hibernate-after must not be negative")
+	}
+	if *lengthCacheSeconds < 0 || *lengthCacheSeconds > 3600 {
+		log.Fatalf("queue-length-cache must be between 0 and 3600 seconds")
+	}
+	if *maxDBBytes < 0 {
+		log.Fatalf("max-db-bytes must not be negative")
+	}
+
+	if *maxReceivesFlag < 1 {
+		log.Fatalf("max-receives must be at least 1")
+	}
+
+	if *visibilityTimeoutSeconds < 1 || *visibilityTimeoutSeconds > maxVisibilityTimeout {
+		log.Fatalf("default-visibility-timeout must be between 1 and %d seconds", maxVisibilityTimeout)
+	}
+
+	if *tokenFormat != TokenUUIDv4 && *tokenFormat != TokenUUIDv7 && *tokenFormat != TokenULID {
+		log.Fatalf("token-format must be %s, %s or %s", TokenUUIDv4, TokenUUIDv7, TokenULID)
+	}
+
+	if *accessLogFormat != AccessLogJSON && *accessLogFormat != AccessLogCLF && *accessLogFormat != AccessLogCombined {
+		log.Fatalf("access-log-format must be %s, %s or %s", AccessLogJSON, AccessLogCLF, AccessLogCombined)
+	}
+
+	if *poisonAction != PoisonDrop && *poisonAction != PoisonDeadLetter {
+		log.Fatalf("poison-action must be %s or %s", PoisonDrop, PoisonDeadLetter)
+	}
+
+	if *writeTimeoutSeconds < 0 {
+		log.Fatalf("write-timeout cannot be negative")
+	}
+
+	if *drainTimeoutSeconds < 0 {
+		log.Fatalf("drain-timeout cannot be negative")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("tls-cert and tls-key must be given together")
+	}
+
+	if *tlsClientCA != "" && *tlsCert == "" {
+		log.Fatalf("tls-client-ca requires tls-cert and tls-key")
+	}
+
+	normalizeQueueNames = *normalizeNames
+	strictJSON = *strictJSONFlag
+	enqueueAccepted = *enqueueAcceptedFlag
+	requireUTF8 = *requireUTF8Flag
+	callbackAllowPrivate = *callbackAllowPrivateFlag
+	callbackHostList := []string{}
+	for _, h := range strings.Split(*callbackHostsFlag, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" && !callbackHosts[h] {
+			callbackHosts[h] = true
+			callbackHostList = append(callbackHostList, h)
+		}
+	}
+
 	validate = validator.New()
 	validate.RegisterValidation("queue_name", func(fl validator.FieldLevel) bool {
 		re := regexp.MustCompile(`^[a-zA-Z0-9-_]+$`)
@@ -660,22 +8633,322 @@ func main() {
 
 	maxMessageSize := *maxMessageSizeKB * 1024
 
-	queue, err := NewMessageQueue(dbFilePath, *maxQueueLength, maxMessageSize)
+	maxBlobSize := *maxBlobSizeMB * 1024 * 1024
+	if *blobDir != "" {
+		if maxBlobSize <= maxMessageSize {
+			log.Fatalf("max-blob-size must exceed max-message-size")
+		}
+		if err := os.MkdirAll(*blobDir, 0700); err != nil {
+			log.Fatalf("failed to create blob directory: %v", err)
+		}
+		if !*memory {
+			absBlobDir, err := filepath.Abs(*blobDir)
+			if err != nil {
+				log.Fatalf("failed to resolve blob directory: %v", err)
+			}
+			absDBPath, err := filepath.Abs(dbFilePath)
+			if err != nil {
+				log.Fatalf("failed to resolve database path: %v", err)
+			}
+			if rel, err := filepath.Rel(absBlobDir, absDBPath); err == nil && !strings.HasPrefix(rel, "..") {
+				log.Fatalf("blob-dir must not contain the database file %s", dbFilePath)
+			}
+		}
+	}
+
+	var encryptionKey []byte
+	if *encryptionKeyHex != "" {
+		key, err := hex.DecodeString(*encryptionKeyHex)
+		if err != nil {
+			log.Fatalf("encryption-key must be hex encoded: %v", err)
+		}
+		encryptionKey = key
+	}
+
+	var keyring map[string][]byte
+	if *keyringPath != "" {
+		var err error
+		keyring, err = loadKeyring(*keyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var tokenSecret []byte
+	if *tokenSecretHex != "" {
+		secret, err := hex.DecodeString(*tokenSecretHex)
+		if err != nil {
+			log.Fatalf("token-secret must be hex encoded: %v", err)
+		}
+		if len(secret) < 16 {
+			log.Fatalf("token-secret must be at least 16 bytes (32 hex digits)")
+		}
+		tokenSecret = secret
+	}
+
+	options := MessageQueueOptions{
+		MaxQueueLength:     *maxQueueLength,
+		MaxMessageSize:     maxMessageSize,
+		EncryptionKey:      encryptionKey,
+		Keyring:            keyring,
+		TablePerQueue:      *tablePerQueue,
+		CleanupLockTimeout: time.Duration(*cleanupLockTimeoutMs) * time.Millisecond,
+		CleanupInterval:    time.Duration(*cleanupIntervalSeconds) * time.Second,
+		TokenSecret:        tokenSecret,
+		TokenFormat:        *tokenFormat,
+		RecoverInFlight:    *recoverInFlight,
+		MaxInFlight:        *maxInFlight,
+		PoisonAction:       *poisonAction,
+		ReadConnections:    *readConnections,
+		BlobDir:            *blobDir,
+		MaxBlobSize:        maxBlobSize,
+		ReadOnly:           *readOnly,
+		MaxReceives:        *maxReceivesFlag,
+		VisibilityTimeout:  *visibilityTimeoutSeconds,
+		HibernateAfter:     time.Duration(*hibernateAfterSeconds) * time.Second,
+		LengthCacheTTL:     time.Duration(*lengthCacheSeconds) * time.Second,
+		MaxDBBytes:         *maxDBBytes,
+		SQLiteParams:       sqliteParamsValue,
+	}
+
+	if *benchmark {
+		if *benchmarkConcurrency < 1 || *benchmarkSeconds < 1 || *benchmarkMessageSize < 1 {
+			log.Fatalf("benchmark-concurrency, benchmark-duration and benchmark-message-size must be positive")
+		}
+		if *benchmarkMessageSize > maxMessageSize {
+			log.Fatalf("benchmark-message-size cannot exceed max-message-size")
+		}
+
+		// The benchmark never touches the real queues. It uses a scratch
+		// database next to the real one, so it measures the same disk
+		benchmarkPath := dbFilePath
+		if !*memory {
+			f, err := os.CreateTemp(filepath.Dir(dbFilePath), "sasquatch-benchmark-*.db")
+			if err != nil {
+				log.Fatalf("failed to create benchmark database: %v", err)
+			}
+			f.Close()
+			benchmarkPath = f.Name()
+		}
+		benchmarkOptions := options
+		benchmarkOptions.RecoverInFlight = false
+		benchmarkOptions.MaxInFlight = 0
+		benchmarkOptions.ReadConnections = 0
+		benchmarkOptions.BlobDir = ""
+		benchmarkOptions.MaxBlobSize = 0
+		benchmarkOptions.MaxDBBytes = 0
+		queue, err := NewMessageQueue(benchmarkPath, benchmarkOptions)
+		if err == nil {
+			err = runBenchmark(queue, *benchmarkConcurrency, time.Duration(*benchmarkSeconds)*time.Second, *benchmarkMessageSize)
+		}
+		if !*memory {
+			for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+				os.Remove(benchmarkPath + suffix)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	queue, err := NewMessageQueue(dbFilePath, options)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	http.HandleFunc("/enqueue", enqueueHandler(queue))
-	http.HandleFunc("/dequeue", dequeueHandler(queue))
-	http.HandleFunc("/delete", deleteHandler(queue))
-	http.HandleFunc("/delete_all", deleteAllHandler(queue))
-	http.HandleFunc("/queue_length", getQueueLengthHandler(queue))
-	http.HandleFunc("/queues", getUniqueQueueNamesHandler(queue))
-	http.HandleFunc("/stats", statsHandler())
+	disabledEndpoints := map[string]bool{}
+	disabledList := []string{}
+	for _, name := range strings.Split(*disableEndpoints, ",") {
+		name = strings.Trim(strings.TrimSpace(name), "/")
+		if name != "" && !disabledEndpoints[name] {
+			disabledEndpoints[name] = true
+			disabledList = append(disabledList, name)
+		}
+	}
+
+	config := ServerConfig{
+		Version:                  version,
+		Host:                     *host,
+		Port:                     *port,
+		DatabasePath:             dbFilePath,
+		MaxQueueLength:           *maxQueueLength,
+		MaxMessageSize:           maxMessageSize,
+		MaxConnections:           *maxConnections,
+		MaxInFlight:              *maxInFlight,
+		ReadConnections:          *readConnections,
+		SQLiteParams:             sqliteParamsValue,
+		MaxLongPollsPerQueue:     *maxLongPollsPerQueue,
+		EncryptionKey:            redact(*encryptionKeyHex),
+		Keyring:                  *keyringPath,
+		TokenSecret:              redact(*tokenSecretHex),
+		TokenFormat:              *tokenFormat,
+		TLSCertFile:              *tlsCert,
+		TLSKeyFile:               *tlsKey,
+		TLSClientCAFile:          *tlsClientCA,
+		NormalizeQueueNames:      *normalizeNames,
+		StrictJSON:               *strictJSONFlag,
+		EnqueueAccepted:          *enqueueAcceptedFlag,
+		RequireUTF8:              *requireUTF8Flag,
+		ReadOnly:                 *readOnly,
+		AccessLogFormat:          *accessLogFormat,
+		RecoverInFlight:          *recoverInFlight,
+		TablePerQueue:            *tablePerQueue,
+		DefaultVisibilityTimeout: *visibilityTimeoutSeconds,
+		MaxVisibilityTimeout:     maxVisibilityTimeout,
+		MaxReceives:              *maxReceivesFlag,
+		CleanupIntervalSeconds:   *cleanupIntervalSeconds,
+		HibernateAfterSeconds:    *hibernateAfterSeconds,
+		QueueLengthCacheSeconds:  *lengthCacheSeconds,
+		MaxDBBytes:               *maxDBBytes,
+		CleanupLockTimeoutMs:     *cleanupLockTimeoutMs,
+		PoisonAction:             *poisonAction,
+		BlobDir:                  *blobDir,
+		MaxBlobSize:              maxBlobSize,
+		LongPollTimeoutSeconds:   int(longPollTimeout / time.Second),
+		WriteTimeoutSeconds:      *writeTimeoutSeconds,
+		DrainToFile:              *drainToFilePath,
+		DrainTimeoutSeconds:      *drainTimeoutSeconds,
+		CallbackHosts:            callbackHostList,
+		CallbackAllowPrivate:     *callbackAllowPrivateFlag,
+		DisabledEndpoints:        disabledList,
+	}
+	writeTimeout := time.Duration(*writeTimeoutSeconds) * time.Second
+
+	// Endpoints named in --disable-endpoints are never registered, so they
+	// answer 404 like any unknown path
+	registered := map[string]bool{}
+	handle := func(pattern string, handler http.HandlerFunc) {
+		path := pattern
+		if _, after, ok := strings.Cut(pattern, " "); ok {
+			path = after
+		}
+		name := strings.TrimPrefix(path, "/")
+		registered[name] = true
+		if !disabledEndpoints[name] {
+			http.HandleFunc(pattern, handler)
+		}
+	}
+
+	handle("/enqueue", enqueueHandler(queue))
+	handle("/enqueue_fanout", enqueueFanoutHandler(queue))
+	handle("POST /enqueue_batch", enqueueBatchHandler(queue))
+	handle("/dequeue", withWriteDeadline(dequeueHandler(queue, newLongPollLimiter(*maxLongPollsPerQueue)), writeTimeout, longPollTimeout))
+	handle("/dequeue_by_id", dequeueByIDHandler(queue))
+	handle("POST /claim_all", claimAllHandler(queue))
+	handle("/delete", deleteHandler(queue))
+	handle("POST /release", releaseHandler(queue))
+	handle("POST /reroute", rerouteHandler(queue))
+	handle("POST /fail", failHandler(queue))
+	handle("POST /heartbeat", heartbeatHandler(queue))
+	handle("POST /extend_visibility", extendVisibilityHandler(queue))
+	handle("POST /set_label", setLabelHandler(queue))
+	handle("/delete_all", deleteAllHandler(queue))
+	handle("/reprioritize", reprioritizeHandler(queue))
+	handle("/replay", replayHandler(queue))
+	handle("POST /recover_stuck", recoverStuckHandler(queue))
+	handle("POST /purge_poison", purgePoisonHandler(queue))
+	handle("/remove_consumer_group", removeConsumerGroupHandler(queue))
+	handle("/queue_length", getQueueLengthHandler(queue))
+	handle("HEAD /queue_length", headQueueLengthHandler(queue))
+	handle("/queues", getUniqueQueueNamesHandler(queue))
+	handle("HEAD /queues", headUniqueQueueNamesHandler(queue))
+	handle("/queues/all", getAllQueuesHandler(queue))
+	handle("GET /messages", listMessagesHandler(queue))
+	handle("POST /peek", peekHandler(queue))
+	handle("GET /queues/{name}/messages/{id}", getMessageHandler(queue))
+	handle("GET /my_leases", getLeasesHandler(queue))
+	handle("GET /inflight", inFlightHandler(queue))
+	handle("GET /active_consumers", activeConsumersHandler(queue))
+	handle("GET /position", positionHandler(queue))
+	handle("GET /scaling", scalingHandler(queue))
+	handle("GET /queues/{name}/config", getQueueConfigHandler(queue))
+	handle("PUT /queues/{name}/config", setQueueConfigHandler(queue))
+	handle("GET /export_config", exportConfigHandler(queue))
+	handle("POST /import_config", importConfigHandler(queue))
+	handle("/stats", statsHandler(queue))
+	handle("GET /stats.json", statsJSONHandler(queue))
+	handle("GET /metrics", metricsHandler(queue))
+	handle("/stats/drain", drainStatsHandler())
+	handle("GET /queue_stats", queueStatsHandler(queue))
+	handle("GET /queue_rate", queueRateHandler())
+	handle("GET /wait_empty", withWriteDeadline(waitEmptyHandler(queue), writeTimeout, maxWaitEmptyTimeout))
+	handle("GET /events", eventsHandler(queue))
+	handle("POST /admin/flush", flushHandler(queue))
+	handle("/config", configHandler(config))
+	for name := range disabledEndpoints {
+		if !registered[name] {
+			log.Fatalf("disable-endpoints: unknown endpoint %q", name)
+		}
+	}
 
 	address := fmt.Sprintf("%s:%s", *host, *port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *maxConnections > 0 {
+		// Connections beyond the limit wait in the kernel accept backlog
+		listener = netutil.LimitListener(listener, *maxConnections)
+	}
+
+	var handler http.Handler = http.DefaultServeMux
+	if *readOnly {
+		handler = withReadOnly(handler)
+	}
+	var draining atomic.Bool
+	handler = withDrain(handler, &draining)
+	// Access log lines go to stdout without the timestamp prefix of the
+	// server log, so log pipelines can parse them as they are
+	handler = withAccessLog(withCompression(handler), log.New(os.Stdout, "", 0), *accessLogFormat)
+	// Requests run in a context that shutdown cancels, which ends long
+	// polls, /wait_empty and /events streams instead of waiting them out
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	server := &http.Server{Handler: handler, ConnState: trackConnections, WriteTimeout: writeTimeout, BaseContext: func(net.Listener) context.Context { return requestsCtx }}
+	server.RegisterOnShutdown(cancelRequests)
+	if *tlsClientCA != "" {
+		caPEM, err := ioutil.ReadFile(*tlsClientCA)
+		if err != nil {
+			log.Fatalf("failed to read tls-client-ca: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			log.Fatalf("tls-client-ca %s contains no PEM certificates", *tlsClientCA)
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-signals
+		// A second signal stops the server right away
+		signal.Stop(signals)
+		defer close(stopped)
+		if *drainToFilePath == "" {
+			shutdown(server)
+			return
+		}
+		if err := drainToFile(queue, server, &draining, *drainToFilePath, time.Duration(*drainTimeoutSeconds)*time.Second); err != nil {
+			log.Fatalf("failed to drain: %v", err)
+		}
+	}()
+
 	log.Printf("Server started at %s\n", address)
-	if err := http.ListenAndServe(address, nil); err != nil {
+	if *tlsCert != "" {
+		err = server.ServeTLS(listener, *tlsCert, *tlsKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+
+	// Serve returns as soon as shutdown begins, so wait for the requests
+	<-stopped
+	if err := queue.Close(); err != nil {
+		log.Fatalf("failed to close the queue: %v", err)
+	}
+	log.Printf("Server stopped")
 }
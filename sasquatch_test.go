@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testQueueOptions returns the options the server runs with by default.
+func testQueueOptions() MessageQueueOptions {
+	return MessageQueueOptions{
+		MaxQueueLength:     5000,
+		MaxMessageSize:     256 * 1024,
+		CleanupLockTimeout: 500 * time.Millisecond,
+		CleanupInterval:    defaultCleanupInterval,
+		TokenFormat:        TokenUUIDv4,
+		PoisonAction:       PoisonDrop,
+		MaxReceives:        defaultMaxReceives,
+		VisibilityTimeout:  defaultVisibilityTimeout,
+	}
+}
+
+// newTestQueue opens a queue on dbFilePath with the server's defaults and
+// closes it when the test ends.
+func newTestQueue(t *testing.T, dbFilePath string) *MessageQueue {
+	t.Helper()
+	mq, err := NewMessageQueue(dbFilePath, testQueueOptions())
+	if err != nil {
+		t.Fatalf("NewMessageQueue: %v", err)
+	}
+	t.Cleanup(func() { mq.Close() })
+	return mq
+}
+
+// enqueue adds message to queueName with priority, failing the test on error.
+func enqueue(t *testing.T, mq *MessageQueue, queueName, message string, priority int) int {
+	t.Helper()
+	result, err := mq.Enqueue(queueName, []byte(message), priority, "", "", 0, false)
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	return int(result.MessageID)
+}
+
+// A visibility timeout of 0 falls back to the default rather than leaving
+// the message visible, which would let every consumer receive it.
+func TestConcurrentDequeueWithZeroTimeoutDeliversOnce(t *testing.T) {
+	mq := newTestQueue(t, ":memory:")
+	enqueue(t, mq, "q", "only", 0)
+
+	const consumers = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	delivered := 0
+	start := make(chan struct{})
+	for i := 0; i < consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			msg, err := mq.Dequeue("q", 0, 1, false, "", "")
+			if err != nil {
+				t.Errorf("Dequeue: %v", err)
+				return
+			}
+			if msg != nil {
+				mu.Lock()
+				delivered++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if delivered != 1 {
+		t.Fatalf("message delivered %d times, want 1", delivered)
+	}
+	if again, err := mq.Dequeue("q", 0, 1, false, "", ""); err != nil || again != nil {
+		t.Fatalf("Dequeue right after = %v, %v; want nothing", again, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       QueueConfig
+		receiveCount int
+		want         int
+	}{
+		{"no backoff configured", QueueConfig{}, 3, 0},
+		{"first delivery", QueueConfig{BackoffBaseSeconds: 2}, 0, 0},
+		{"first retry", QueueConfig{BackoffBaseSeconds: 2}, 1, 2},
+		{"second retry doubles", QueueConfig{BackoffBaseSeconds: 2}, 2, 4},
+		{"third retry doubles again", QueueConfig{BackoffBaseSeconds: 2}, 3, 8},
+		{"custom multiplier", QueueConfig{BackoffBaseSeconds: 2, BackoffMultiplier: 3}, 3, 18},
+		{"below the max", QueueConfig{BackoffBaseSeconds: 2, BackoffMaxSeconds: 10}, 3, 8},
+		{"clamped at the max", QueueConfig{BackoffBaseSeconds: 2, BackoffMaxSeconds: 10}, 5, 10},
+		{"max without growth left", QueueConfig{BackoffBaseSeconds: 2, BackoffMaxSeconds: 10}, 30, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.retryBackoff(tt.receiveCount); got != tt.want {
+				t.Errorf("retryBackoff(%d) = %d, want %d", tt.receiveCount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoffJitter(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       QueueConfig
+		receiveCount int
+		min, max     int
+	}{
+		{"spread around the backoff", QueueConfig{BackoffBaseSeconds: 10, BackoffJitter: 0.5}, 1, 5, 15},
+		{"spread after growth", QueueConfig{BackoffBaseSeconds: 10, BackoffJitter: 0.2}, 3, 32, 48},
+		{"never above the max", QueueConfig{BackoffBaseSeconds: 10, BackoffJitter: 0.5, BackoffMaxSeconds: 12}, 1, 5, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				got := tt.config.retryBackoff(tt.receiveCount)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("retryBackoff(%d) = %d, want between %d and %d", tt.receiveCount, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestLeaseSeconds(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            QueueConfig
+		visibilityTimeout int
+		receiveCount      int
+		want              int
+	}{
+		{"plain timeout", QueueConfig{}, 30, 2, 30},
+		{"first delivery has no backoff", QueueConfig{BackoffBaseSeconds: 10}, 30, 0, 30},
+		{"backoff on top of the timeout", QueueConfig{BackoffBaseSeconds: 10}, 30, 2, 50},
+		{"redelivery delay replaces a shorter timeout", QueueConfig{RedeliveryDelaySeconds: 60, BackoffBaseSeconds: 10}, 30, 1, 70},
+		{"redelivery delay skipped on first delivery", QueueConfig{RedeliveryDelaySeconds: 60}, 30, 0, 30},
+		{"clamped by the backoff max", QueueConfig{BackoffBaseSeconds: 10, BackoffMaxSeconds: 15}, 30, 4, 45},
+		{"clamped at the longest visibility timeout", QueueConfig{BackoffBaseSeconds: 10}, 30, 20, maxVisibilityTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.leaseSeconds(tt.visibilityTimeout, tt.receiveCount); got != tt.want {
+				t.Errorf("leaseSeconds(%d, %d) = %d, want %d", tt.visibilityTimeout, tt.receiveCount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInFlightMessageRedeliveredAfterVisibilityTimeout(t *testing.T) {
+	mq := newTestQueue(t, ":memory:")
+	id := enqueue(t, mq, "q", "retry me", 0)
+
+	first, err := mq.Dequeue("q", 1, 1, false, "", "")
+	if err != nil || first == nil {
+		t.Fatalf("first Dequeue = %v, %v; want the message", first, err)
+	}
+	if again, err := mq.Dequeue("q", 1, 1, false, "", ""); err != nil || again != nil {
+		t.Fatalf("Dequeue while in flight = %v, %v; want nothing", again, err)
+	}
+
+	// Visibility deadlines have a resolution of one second
+	time.Sleep(2100 * time.Millisecond)
+
+	second, err := mq.Dequeue("q", 1, 1, false, "", "")
+	if err != nil || second == nil {
+		t.Fatalf("Dequeue after the timeout = %v, %v; want the message again", second, err)
+	}
+	if second.MessageID != id {
+		t.Errorf("redelivered message %d, want %d", second.MessageID, id)
+	}
+	if second.ReceiveCount != 2 {
+		t.Errorf("receive count %d, want 2", second.ReceiveCount)
+	}
+	if second.DeleteToken == first.DeleteToken {
+		t.Error("redelivery reused the first delete token")
+	}
+}
+
+func TestRestartedConsumerRecoversLeases(t *testing.T) {
+	mq := newTestQueue(t, ":memory:")
+	id := enqueue(t, mq, "q", "mine", 0)
+	otherID := enqueue(t, mq, "q", "theirs", 0)
+
+	msg, err := mq.Dequeue("q", 30, 1, false, "w1", "")
+	if err != nil || msg == nil || msg.MessageID != id {
+		t.Fatalf("Dequeue as w1 = %v, %v; want message %d", msg, err, id)
+	}
+	if other, err := mq.Dequeue("q", 30, 1, false, "w2", ""); err != nil || other == nil || other.MessageID != otherID {
+		t.Fatalf("Dequeue as w2 = %v, %v; want message %d", other, err, otherID)
+	}
+
+	// The consumer restarts and loses the delete token, which is only kept
+	// here to compare with the recovered one
+	token := msg.DeleteToken
+
+	leases, err := mq.GetLeases("w1")
+	if err != nil {
+		t.Fatalf("GetLeases: %v", err)
+	}
+	if len(leases) != 1 {
+		t.Fatalf("GetLeases returned %d leases, want 1: %+v", len(leases), leases)
+	}
+	if leases[0].MessageID != id || leases[0].DeleteToken != token || leases[0].QueueName != "q" {
+		t.Fatalf("GetLeases returned message %d of queue %s with token %q, want %d of q with %q", leases[0].MessageID, leases[0].QueueName, leases[0].DeleteToken, id, token)
+	}
+
+	deleted, err := mq.DeleteMessage(leases[0].DeleteToken)
+	if err != nil || !deleted {
+		t.Fatalf("DeleteMessage with the recovered token = %v, %v; want true", deleted, err)
+	}
+	if leases, err := mq.GetLeases("w1"); err != nil || len(leases) != 0 {
+		t.Fatalf("GetLeases after the delete = %+v, %v; want none", leases, err)
+	}
+	if leases, err := mq.GetLeases("w2"); err != nil || len(leases) != 1 || leases[0].MessageID != otherID {
+		t.Fatalf("GetLeases of w2 = %+v, %v; want only message %d", leases, err, otherID)
+	}
+}
+
+func TestReadsDoNotWaitForDequeueLock(t *testing.T) {
+	// Every connection to ":memory:" is the same single one, which the
+	// write transaction below would hold, so this needs a database file
+	mq := newTestQueue(t, filepath.Join(t.TempDir(), "queue.db"))
+	enqueue(t, mq, "q", "first", 0)
+	enqueue(t, mq, "q", "second", 0)
+
+	// Hold the queue lock and an open write, as a dequeue does
+	mq.lock.Lock()
+	tx, err := mq.db.Begin()
+	if err != nil {
+		mq.lock.Unlock()
+		t.Fatalf("Begin: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE messages SET receive_count = receive_count + 1 WHERE queue_name = ?", "q"); err != nil {
+		tx.Rollback()
+		mq.lock.Unlock()
+		t.Fatalf("Exec: %v", err)
+	}
+	defer mq.lock.Unlock()
+	defer tx.Rollback()
+
+	done := make(chan error, 1)
+	go func() {
+		length, err := mq.GetQueueLength("q", false)
+		if err == nil && length != 2 {
+			err = fmt.Errorf("queue length %d, want 2", length)
+		}
+		if err == nil {
+			_, _, _, err = mq.GetQueueDepth("q")
+		}
+		if err == nil {
+			_, err = mq.GetUniqueQueueNames(false)
+		}
+		if err == nil {
+			_, err = collectStats(mq)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("depth and stats queries blocked while a dequeue held the lock")
+	}
+}
+
+func TestFailWithNewPriorityAffectsNextDequeue(t *testing.T) {
+	mq := newTestQueue(t, ":memory:")
+	first := enqueue(t, mq, "q", "first", 5)
+	second := enqueue(t, mq, "q", "second", 5)
+
+	msg, err := mq.Dequeue("q", 30, 1, false, "", "")
+	if err != nil || msg == nil || msg.MessageID != first {
+		t.Fatalf("Dequeue = %v, %v; want message %d", msg, err, first)
+	}
+	newPriority := 1
+	failed, err := mq.Fail(msg.DeleteToken, false, &newPriority)
+	if err != nil {
+		t.Fatalf("Fail: %v", err)
+	}
+	if failed.Priority != 1 {
+		t.Errorf("Fail reported priority %d, want 1", failed.Priority)
+	}
+
+	next, err := mq.Dequeue("q", 30, 1, false, "", "")
+	if err != nil || next == nil || next.MessageID != second {
+		t.Fatalf("Dequeue after Fail = %v, %v; want message %d", next, err, second)
+	}
+
+	// Skip the retry backoff instead of waiting for it
+	if _, err := mq.db.Exec("UPDATE messages SET visibility_timestamp = 0 WHERE id = ?", first); err != nil {
+		t.Fatalf("failed to make message visible: %v", err)
+	}
+	retried, err := mq.Dequeue("q", 30, 1, false, "", "")
+	if err != nil || retried == nil || retried.MessageID != first {
+		t.Fatalf("Dequeue of the failed message = %v, %v; want message %d", retried, err, first)
+	}
+	if retried.Priority != 1 {
+		t.Errorf("failed message came back with priority %d, want 1", retried.Priority)
+	}
+}
+
+func TestSamePriorityDequeuesOldestFirst(t *testing.T) {
+	mq := newTestQueue(t, ":memory:")
+	var ids []int
+	for _, message := range []string{"first", "second", "third"} {
+		ids = append(ids, enqueue(t, mq, "q", message, 3))
+	}
+
+	for i, want := range ids {
+		msg, err := mq.Dequeue("q", 30, 1, false, "", "")
+		if err != nil || msg == nil {
+			t.Fatalf("Dequeue %d = %v, %v; want a message", i+1, msg, err)
+		}
+		if msg.MessageID != want {
+			t.Fatalf("Dequeue %d returned message %d, want %d", i+1, msg.MessageID, want)
+		}
+	}
+}
+
+func TestDelayedMessagesLeftOutOfQueueLength(t *testing.T) {
+	mq := newTestQueue(t, ":memory:")
+	enqueue(t, mq, "q", "now", 0)
+	if _, err := mq.Enqueue("q", []byte("later"), 0, "", "", 1, false); err != nil {
+		t.Fatalf("Enqueue with delay: %v", err)
+	}
+
+	checkCounts := func(wantLength, wantDelayed int) {
+		t.Helper()
+		length, err := mq.GetQueueLength("q", false)
+		if err != nil {
+			t.Fatalf("GetQueueLength: %v", err)
+		}
+		delayed, err := mq.GetDelayedCount("q")
+		if err != nil {
+			t.Fatalf("GetDelayedCount: %v", err)
+		}
+		if length != wantLength || delayed != wantDelayed {
+			t.Errorf("length %d with %d delayed, want %d with %d delayed", length, delayed, wantLength, wantDelayed)
+		}
+	}
+
+	checkCounts(1, 1)
+
+	// Delays have a resolution of one second
+	time.Sleep(2100 * time.Millisecond)
+
+	checkCounts(2, 0)
+}
+
+func TestExtendVisibilityRenewsSignedToken(t *testing.T) {
+	opts := testQueueOptions()
+	opts.TokenSecret = []byte("0123456789abcdef")
+	mq, err := NewMessageQueue(":memory:", opts)
+	if err != nil {
+		t.Fatalf("NewMessageQueue: %v", err)
+	}
+	defer mq.Close()
+	id := enqueue(t, mq, "q", "slow work", 0)
+
+	msg, err := mq.Dequeue("q", 1, 1, false, "", "")
+	if err != nil || msg == nil {
+		t.Fatalf("Dequeue = %v, %v; want the message", msg, err)
+	}
+	extended, err := mq.ChangeVisibility(msg.DeleteToken, 30)
+	if err != nil {
+		t.Fatalf("ChangeVisibility: %v", err)
+	}
+	if extended.MessageID != id || extended.DeleteToken == msg.DeleteToken {
+		t.Fatalf("ChangeVisibility returned message %d with token %q, want %d with a new token", extended.MessageID, extended.DeleteToken, id)
+	}
+
+	// Wait until the original lease, and with it the old token, has expired
+	time.Sleep(2100 * time.Millisecond)
+
+	if again, err := mq.Dequeue("q", 1, 1, false, "", ""); err != nil || again != nil {
+		t.Fatalf("Dequeue after the original lease = %v, %v; want nothing", again, err)
+	}
+	if _, err := mq.DeleteMessage(msg.DeleteToken); err != ErrDeleteTokenExpired {
+		t.Errorf("DeleteMessage with the old token: %v, want %v", err, ErrDeleteTokenExpired)
+	}
+	deleted, err := mq.DeleteMessage(extended.DeleteToken)
+	if err != nil || !deleted {
+		t.Fatalf("DeleteMessage with the new token = %v, %v; want true", deleted, err)
+	}
+}